@@ -3,17 +3,28 @@ package migrate
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"hash/fnv"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/heroiclabs/sql-migrate/sqlparse"
@@ -26,21 +37,460 @@ const (
 	Down
 )
 
+// AllowedDirections restricts the directions migrations can be executed or
+// planned in, see MigrationSet.AllowedDirections.
+type AllowedDirections int
+
+const (
+	// BothDirections allows migrating Up and Down.
+	BothDirections AllowedDirections = iota
+	// UpOnly refuses to migrate Down, for environments such as production
+	// where reverting migrations is never intended.
+	UpOnly
+)
+
+// ErrDownDisabled is returned when migrating Down with UpOnly directions.
+var ErrDownDisabled = errors.New("down migrations are disabled in this configuration")
+
 // MigrationSet provides database parameters for a migration execution
 type MigrationSet struct {
 	// TableName name of the table used to store migration info.
 	TableName string
+	// SchemaName schema that the migration table be referenced. Defaults to
+	// resolving the table through the search_path.
+	SchemaName string
 	// IgnoreUnknown skips the check to see if there is a migration
 	// ran in the database that is not in MigrationSource.
 	//
 	// This should be used sparingly as it is removing a safety check.
 	IgnoreUnknown bool
-	// DisableCreateTable disable the creation of the migration table
+	// OnUnknownMigration decides, for each applied migration missing from
+	// the source, whether to ignore it as IgnoreUnknown does, or to fail
+	// planning, with its own error if it returns one. It is not called when
+	// IgnoreUnknown is set.
+	OnUnknownMigration func(record MigrationRecord) (ignore bool, err error)
+	// DisableCreateTable disable the creation of the migration table. The
+	// table must then exist with the columns of this version, which
+	// executions and plans check first. Tables created by earlier versions
+	// are upgraded by EnsureTableSchema.
 	DisableCreateTable bool
+	// RequireUp makes planning fail if any migration in the source has no
+	// Up statements.
+	RequireUp bool
+	// RequireDown makes planning fail if any migration in the source has no
+	// Down statements, effectively forbidding forward-only migrations.
+	RequireDown bool
+	// MaxStatementsPerMigration makes planning fail if any migration in the
+	// source has more Up or Down statements. It guards against migrations
+	// accidentally concatenated by a generator. Defaults to no limit.
+	MaxStatementsPerMigration int
+	// AllowMissingDown lets migrations without Down statements be reverted
+	// by only deleting their record. By default planning them Down fails.
+	AllowMissingDown bool
+	// OnAcquireConn is called once with the connection dedicated to an
+	// execution, before any migration is planned or applied. It can be used
+	// to set session state, such as the role or GUCs, that persists for the
+	// whole run.
+	OnAcquireConn func(ctx context.Context, conn Queryer) error
+	// ApplicationName is set as the application_name of the connection for
+	// the duration of an execution, so that migration queries can be told
+	// apart in pg_stat_activity. The previous value is restored afterwards.
+	// Defaults to leaving it unchanged.
+	ApplicationName string
+	// Role is set with SET ROLE while the statements of each migration run,
+	// so that the objects they create are owned by it rather than by the
+	// current role of the connection. It is set locally to the transaction
+	// of the migration, and the previous role is set back after
+	// notransaction migrations. Defaults to the current role, such as one
+	// set by OnAcquireConn.
+	Role string
+	// RecordsRole is the role the records of the migrations are written
+	// under. Defaults to Role.
+	RecordsRole string
+	// SkipUnmetRequirements records migrations whose requirements are not met
+	// by the database as applied without running their statements. By
+	// default such migrations make the execution fail.
+	SkipUnmetRequirements bool
+	// MaxRetries is the number of times a migration which failed with a
+	// retryable error is attempted again. Defaults to no retries.
+	// notransaction migrations are never retried, as their record is left
+	// dirty once they fail.
+	MaxRetries int
+	// IsRetryable decides whether a failed migration can be retried. Defaults
+	// to retrying errors which pgx reports as safe to retry, such as a
+	// connection failure before the statement was sent.
+	IsRetryable func(err error) bool
+	// OnProgress is called before each migration is applied, with the
+	// 1-based position of the migration in the plan and the total number of
+	// planned migrations.
+	OnProgress func(current, total int, m *Migration)
+	// RecordProvenance records the OS hostname and Actor in the applied_by
+	// and hostname columns of the migration table for every applied
+	// migration.
+	RecordProvenance bool
+	// Actor identifies who applies the migrations, such as a user or a
+	// deployment job. It is only recorded when RecordProvenance is set.
+	Actor string
+	// IdPattern derives the Id of each migration from its name in the
+	// source, typically the filename, using the first capture group. For
+	// example `^V([\d.]+)__` keeps the version of Flyway-style names such as
+	// V2024.01.02__add_people.sql. Names not matching it make planning fail.
+	// Defaults to using the whole name as Id.
+	IdPattern *regexp.Regexp
+	// DuplicatePrefixPolicy decides what happens when several migrations
+	// share the same numeric prefix, such as 0005_a.sql and 0005_b.sql.
+	// Defaults to AllowDuplicatePrefix.
+	DuplicatePrefixPolicy DuplicatePrefixPolicy
+	// RefuseDowngrade makes planning fail when the source looks older than
+	// the database: its highest migration is below the highest applied one,
+	// or an applied migration is missing from it. It catches code rolled
+	// back without the database, and takes precedence over IgnoreUnknown.
+	RefuseDowngrade bool
+	// UseAdvisoryLock serializes executions against the same migration table
+	// by holding a PostgreSQL advisory lock while migrations are planned and
+	// applied. Waiting for the lock is bounded by the context, and fails
+	// with a *LockTimeoutError once it is done. With a pool, the lock is
+	// taken on the connection held for the whole execution, and released
+	// before the connection is returned to the pool. Executions plan once
+	// they hold the lock, so that those which waited for it see the
+	// migrations applied meanwhile.
+	UseAdvisoryLock bool
+	// LockKey computes the advisory lock key from the schema and table name
+	// of the migration table. Returning the same key for several migration
+	// tables serializes their executions, for example across the schemas of
+	// all tenants. Defaults to a key per migration table.
+	LockKey func(schema, table string) int64
+	// EnableEnvSubstitution replaces ${NAME} tokens in migration statements
+	// with the value of the NAME environment variable when they are
+	// executed, so that secrets such as passwords don't have to be stored in
+	// migration files. Executions referencing unset variables fail before
+	// applying any migration.
+	EnableEnvSubstitution bool
+	// LookupEnv resolves the variables of EnableEnvSubstitution. Defaults
+	// to os.LookupEnv.
+	LookupEnv func(name string) (string, bool)
+	// AfterAll statements, such as ANALYZE, are run once after an execution
+	// which applied at least one migration and succeeded. They run outside
+	// of any transaction and are not recorded.
+	AfterAll []string
+	// KeepRevertedRecords keeps the record of reverted migrations, setting
+	// its reverted_at column instead of deleting it, so that the migration
+	// table holds a history of reverts. Records with reverted_at set are
+	// not considered applied, and are updated if the migration is applied
+	// again, which requires the id column to be unique.
+	KeepRevertedRecords bool
+	// AppliedPredicate is an SQL condition on the columns of the migration
+	// table which records of applied migrations must also satisfy, such as
+	// "status = 'applied'" for teams soft-reverting migrations with a status
+	// column, see RecordColumns. It changes which records are read as
+	// applied: reverting still deletes records, or sets their reverted_at
+	// with KeepRevertedRecords. Applying a migration whose record doesn't
+	// satisfy it replaces the record, resetting the RecordColumns to their
+	// default, which requires the id column to be unique, and fails if the
+	// new record still doesn't satisfy it. It is trusted SQL. Defaults to
+	// every record being applied.
+	AppliedPredicate string
+	// PingQuery is the query WaitForDB uses to check that the database is
+	// ready. Defaults to "SELECT 1".
+	PingQuery string
+	// Logger receives warnings about risky migrations. Defaults to no
+	// logging. A *log.Logger can be used.
+	Logger Logger
+	// StrictNoTransaction makes planning fail, instead of logging a warning,
+	// when a notransaction migration has several statements.
+	StrictNoTransaction bool
+	// RecordsTimeout bounds each query on the migration table, such as
+	// recording an applied migration, independently of the migration
+	// statements which may legitimately run for a long time. A stuck
+	// bookkeeping query then fails fast. Defaults to no timeout.
+	RecordsTimeout time.Duration
+	// AtomicDown reverts all migrations of a Down execution in a single
+	// transaction, each in its own savepoint: if reverting one of them fails,
+	// the migrations already reverted are restored and none is counted as
+	// applied. Executions with notransaction Down migrations fail before
+	// reverting anything, as such migrations cannot run in a transaction.
+	AtomicDown bool
+	// AllowedDirections makes executing or planning migrations in other
+	// directions fail with ErrDownDisabled, before anything is done. Unlike
+	// irreversible migrations, it is meant to be set per environment.
+	// Defaults to BothDirections.
+	AllowedDirections AllowedDirections
+	// RecordDuration records how long each migration took to apply in the
+	// duration_ms column of the migration table, so that slow migrations
+	// can be found across environments.
+	RecordDuration bool
+	// Dialect holds the catalog queries issued by the package, for
+	// PostgreSQL wire-compatible databases whose catalogs differ. Defaults
+	// to the PostgreSQL ones.
+	Dialect Dialect
+	// AppliedIdsCache caches the Ids of the applied migrations for the
+	// read-only checks CurrentVersion and PendingCount, which readiness
+	// probes may call frequently. Executions invalidate it. Defaults to
+	// querying the migration table on every call.
+	AppliedIdsCache *AppliedIdsCache
+	// SquashRecords returns the statements Squash appends to the Up and
+	// Down of a squashed migration for the bookkeeping of the migrations it
+	// replaces on new databases, such as recording them as applied. Defaults
+	// to none, as Replaces already accounts for their records.
+	SquashRecords func(replaced []*Migration) (up, down []string)
+	// ExplainBeforeApply runs EXPLAIN on the INSERT, UPDATE and DELETE
+	// statements of migrations before executing them, and reports their
+	// estimated cost and rows through the Logger. It gives a heads-up on
+	// expensive backfills. Other statements, such as DDL, are not explained.
+	ExplainBeforeApply bool
+	// RunId identifies an execution in the lines it logs, and in the run_id
+	// column of the records it inserts when RecordRunId is set, so that all
+	// artifacts of a deploy can be tied together. Defaults to a random UUID
+	// generated per execution.
+	RunId string
+	// RecordRunId records the RunId of the execution which applied each
+	// migration in the run_id column of the migration table.
+	RecordRunId bool
+	// MaxClockSkew makes executions log a warning through the Logger when
+	// the clock of the database and the one of the process differ by more
+	// than it, as they both end up in applied_at values. It is purely
+	// diagnostic. Defaults to no check.
+	MaxClockSkew time.Duration
+	// RecordColumns declares extra columns of the migration table, mapping
+	// their name to their definition, such as "tenant_id": "BIGINT NOT
+	// NULL". They are added when the table is created or upgraded.
+	RecordColumns map[string]string
+	// RecordInsertDecorator returns extra column values to insert with the
+	// record of each applied migration, such as the distribution column of
+	// a sharded migration table. The columns must exist, see RecordColumns.
+	RecordInsertDecorator func(m *Migration) map[string]any
+	// MinTimeLeft is the time which must be left before the deadline of the
+	// context of an execution to start applying another migration. The
+	// execution otherwise stops between migrations, leaving the applied
+	// ones committed, and fails with ErrTimeBudgetExceeded. It bounds the
+	// total time of an execution to its deadline when migrations are known
+	// to take up to MinTimeLeft. Defaults to only stopping once the
+	// deadline is passed.
+	MinTimeLeft time.Duration
+	// AppliedAtType is the type of the applied_at and reverted_at columns
+	// of the migration table, to adopt an existing table using timestamps
+	// without time zone. When set, executions fail if the applied_at column
+	// of an existing table has another type. Defaults to TimestampTZ,
+	// without checking existing tables.
+	AppliedAtType TimestampType
+	// DisableFillHoles makes planning fail on unapplied migrations with a
+	// lower Id than the last applied one, such as after merges, instead of
+	// applying them first. Holes then have to be filled explicitly with
+	// ExecRange, which selects migrations explicitly and ignores it.
+	DisableFillHoles bool
+	// RequireMigrations makes planning, and ValidateSource, fail with
+	// ErrEmptySource when the source has no migrations, such as with a
+	// misconfigured Dir or Root. Otherwise executions of an empty source
+	// log a warning through the Logger and apply nothing, as if the
+	// database were up to date.
+	RequireMigrations bool
+	// TableCreateOptions controls the physical placement of the migration
+	// table when it is created. It accepts UNLOGGED, for ephemeral test
+	// databases, and TABLESPACE followed by a tablespace name, which is
+	// quoted as is, or both, such as "UNLOGGED TABLESPACE fast". Other
+	// options are refused. Defaults to a plain table.
+	TableCreateOptions string
+	// ExpectDatabase is the name of the database executions must be
+	// connected to. They fail before taking any lock or touching the
+	// migration table otherwise, such as with the credentials of another
+	// environment. Defaults to no check.
+	ExpectDatabase string
+	// ExpectServerVersion is the minimum server version executions
+	// require, such as "14", "14.2" or "9.6", checked along with ExpectDatabase.
+	// Defaults to no check.
+	ExpectServerVersion string
+	// NotifyChannel is a channel notified with the Id of each migration
+	// applied Up, so that LISTENing services can react to schema changes.
+	// Transactional migrations notify in their transaction, so that
+	// listeners only hear about committed migrations. Reverts are not
+	// notified. Defaults to no notifications.
+	NotifyChannel string
+
+	// onResult is called after each migration, see ExecStream.
+	onResult func(result MigrationResult)
+	// tableChecked is set once the migration table was created or checked
+	// by an execution, so that planning doesn't do it again.
+	tableChecked bool
+	// searchPath is prepended to the search_path of the connection for the
+	// duration of an execution, see ExecMultiSchema.
+	searchPath string
+}
+
+// TimestampType is the type of the timestamps of the migration table, see
+// MigrationSet.AppliedAtType.
+type TimestampType string
+
+const (
+	// TimestampTZ is the timestamp with time zone type.
+	TimestampTZ TimestampType = "TIMESTAMPTZ"
+	// Timestamp is the timestamp without time zone type.
+	Timestamp TimestampType = "TIMESTAMP"
+)
+
+// Returns the name of the type in the PostgreSQL catalog.
+func (t TimestampType) catalogName() string {
+	if t == Timestamp {
+		return "timestamp without time zone"
+	}
+	return "timestamp with time zone"
+}
+
+// Dialect holds the catalog queries of a database, see MigrationSet.Dialect.
+type Dialect struct {
+	// TableExistsSQL returns whether a table exists, given its schema as $1
+	// and its name as $2. The schema is empty when the table is resolved
+	// through the search_path. Defaults to DefaultTableExistsSQL.
+	TableExistsSQL string
+}
+
+// DefaultTableExistsSQL looks up tables in the PostgreSQL catalog.
+const DefaultTableExistsSQL = `
+SELECT EXISTS (
+	SELECT 1 FROM pg_catalog.pg_class c
+	JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relname = $2 AND CASE WHEN $1 = '' THEN pg_catalog.pg_table_is_visible(c.oid) ELSE n.nspname = $1 END
+)`
+
+func (d Dialect) tableExistsSQL() string {
+	if d.TableExistsSQL == "" {
+		return DefaultTableExistsSQL
+	}
+	return d.TableExistsSQL
+}
+
+// AppliedIdsCache holds the Ids of the applied migrations for a TTL, see
+// MigrationSet.AppliedIdsCache. It is safe for concurrent use, and must not be
+// shared between migration tables.
+type AppliedIdsCache struct {
+	// TTL is how long the Ids are cached before being queried again. Zero
+	// disables caching.
+	TTL time.Duration
+
+	mu        sync.Mutex
+	ids       []string
+	expiresAt time.Time
+}
+
+// NewAppliedIdsCache returns a cache keeping the applied Ids for ttl.
+func NewAppliedIdsCache(ttl time.Duration) *AppliedIdsCache {
+	return &AppliedIdsCache{TTL: ttl}
+}
+
+// Invalidate drops the cached Ids, so that they are queried on next use.
+func (c *AppliedIdsCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = nil
+	c.expiresAt = time.Time{}
+}
+
+// Returns the cached Ids, or the ones returned by fetch once expired.
+func (c *AppliedIdsCache) get(fetch func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.TTL > 0 && time.Now().Before(c.expiresAt) {
+		return c.ids, nil
+	}
+
+	ids, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.ids = ids
+	c.expiresAt = time.Now().Add(c.TTL)
+	return ids, nil
+}
+
+// Logger is the interface used by MigrationSet to report warnings.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Logs through the Logger, if any, prefixing the line with the RunId of the
+// execution.
+func (ms MigrationSet) logf(format string, v ...any) {
+	if ms.Logger == nil {
+		return
+	}
+	if ms.RunId != "" {
+		format = "run %s: " + format
+		v = append([]any{ms.RunId}, v...)
+	}
+	ms.Logger.Printf(format, v...)
+}
+
+// Returns a random (version 4) UUID.
+func newRunId() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate run id: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Queryer is the database handle migrations are run with. It is satisfied by
+// *pgx.Conn, pgx.Tx and *pgxpool.Pool. Executions given a *pgxpool.Pool, or
+// any ConnPool, acquire one of its connections and hold it for their whole
+// duration, so that the advisory lock and session settings stay on it.
+// Migration statements are executed with a pgx.QueryExecMode as first
+// argument, as pgx handles them.
+//
+// All statements run through it, so a test double implementing it can record
+// the statements of a run and fail them, without a database.
+type Queryer interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// ConnPool is implemented by connection pools able to hand out a connection
+// which is held for a whole execution, so that session state and transactions
+// are guaranteed to stay on the same physical connection. The release function
+// returns the connection to the pool.
+//
+// A *pgxpool.Pool is used as a ConnPool without having to implement it.
+type ConnPool interface {
+	Queryer
+	AcquireConn(ctx context.Context) (conn Queryer, release func(), err error)
+}
+
+// Adapts a *pgxpool.Pool to ConnPool.
+type pgxConnPool struct {
+	*pgxpool.Pool
+}
+
+func (p pgxConnPool) AcquireConn(ctx context.Context) (Queryer, func(), error) {
+	conn, err := p.Acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.Release, nil
+}
+
+// Returns db as a ConnPool if it is a pool of connections.
+func asConnPool(db Queryer) (ConnPool, bool) {
+	switch pool := db.(type) {
+	case ConnPool:
+		return pool, true
+	case *pgxpool.Pool:
+		return pgxConnPool{pool}, true
+	}
+	return nil, false
 }
 
 var migSet = MigrationSet{}
 
+// DefaultMigrationSet returns a copy of the MigrationSet used by the package
+// functions, as configured by SetTable, SetIgnoreUnknown and the like. Fields
+// set on the copy, such as IgnoreUnknown for a single call, don't leak to
+// other callers.
+func DefaultMigrationSet() MigrationSet {
+	return migSet
+}
+
 const DefaultMigrationTableName = "migration_info"
 
 // NewMigrationSet returns a parametrized Migration object
@@ -51,6 +501,20 @@ func (ms MigrationSet) getTableName() string {
 	return ms.TableName
 }
 
+// Returns the table name quoted for use as an SQL identifier.
+func (ms MigrationSet) quotedTableName() string {
+	if ms.SchemaName == "" {
+		return pgx.Identifier{ms.getTableName()}.Sanitize()
+	}
+	return pgx.Identifier{ms.SchemaName, ms.getTableName()}.Sanitize()
+}
+
+// undefined_table error code, returned when querying a missing table.
+const undefinedTableCode = "42P01"
+
+// undefined_column error code, returned when querying a missing column.
+const undefinedColumnCode = "42703"
+
 var numberPrefixRegex = regexp.MustCompile(`^(\d+).*$`)
 
 // PlanError happens where no migration plan could be created between the sets
@@ -92,6 +556,149 @@ func (e *TxError) Error() string {
 	return e.Err.Error() + " handling " + e.Migration.Id
 }
 
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+// StatementError is returned when a statement of a migration fails. Index is
+// the zero-based position of the statement in the migration, and Statement
+// its text before environment substitution.
+type StatementError struct {
+	Migration *Migration
+	Index     int
+	Statement string
+	Err       error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("failed to exec statement %d of migration %s %q: %s", e.Index, e.Migration.Id, e.Statement, e.Err)
+}
+
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// DirtyError is returned when migrations were interrupted while being applied
+// or reverted outside of a transaction, for example because the connection was
+// lost. Their statements may have partially run, so they are not run again
+// blindly: the database has to be repaired, and their record updated, first.
+type DirtyError struct {
+	Ids []string
+}
+
+func (e *DirtyError) Error() string {
+	return "migrations interrupted while running without a transaction: " + strings.Join(e.Ids, ", ") +
+		"; complete or undo their statements, then set dirty to false on their record or delete it"
+}
+
+// DriftError is returned when applied migrations were changed in the source
+// since they were applied.
+type DriftError struct {
+	Migrations []*Migration
+	// Grown lists the changed migrations which have more Up statements
+	// than when they were applied: the added statements never ran. Other
+	// changed migrations had their content edited.
+	Grown []*Migration
+}
+
+func (e *DriftError) Error() string {
+	ids := make([]string, len(e.Migrations))
+	for i, migration := range e.Migrations {
+		ids[i] = migration.Id
+	}
+	msg := "migrations changed since they were applied: " + strings.Join(ids, ", ")
+	if len(e.Grown) > 0 {
+		grown := make([]string, len(e.Grown))
+		for i, migration := range e.Grown {
+			grown[i] = migration.Id
+		}
+		msg += " (statements added to " + strings.Join(grown, ", ") + ")"
+	}
+	return msg
+}
+
+// ConnectionLostError is returned when the database connection is lost while
+// applying migrations. Migrations committed before the connection was lost
+// remain applied and will not run again, so the caller can reconnect and
+// resume by executing the same migrations again.
+type ConnectionLostError struct {
+	Migration *Migration
+	Err       error
+}
+
+func newConnectionLostError(migration *PlannedMigration, err error) error {
+	return &ConnectionLostError{
+		Migration: migration.Migration,
+		Err:       err,
+	}
+}
+
+func (e *ConnectionLostError) Error() string {
+	return "database connection lost handling " + e.Migration.Id + ": " + e.Err.Error()
+}
+
+func (e *ConnectionLostError) Unwrap() error {
+	return e.Err
+}
+
+// LockTimeoutError is returned when the advisory lock could not be acquired
+// before the context was done, typically because another execution is holding
+// it.
+type LockTimeoutError struct {
+	// Waited is how long the lock was waited for.
+	Waited time.Duration
+	Err    error
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("failed to acquire migration lock after %s: %s", e.Waited, e.Err)
+}
+
+func (e *LockTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ErrTimeBudgetExceeded is returned by executions stopped because the deadline
+// of their context was reached, or too close to start another migration. See
+// MigrationSet.MinTimeLeft.
+var ErrTimeBudgetExceeded = errors.New("migration run time budget exceeded")
+
+// ErrEmptySource is returned when a source has no migrations while
+// MigrationSet.RequireMigrations is set.
+var ErrEmptySource = errors.New("migration source has no migrations")
+
+// Fails with ErrTimeBudgetExceeded if the migration should not be started with
+// the time left before the deadline of the context.
+func (ms MigrationSet) checkTimeBudget(ctx context.Context, next *Migration) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	if left := time.Until(deadline); left <= ms.MinTimeLeft || ctx.Err() != nil {
+		return fmt.Errorf("%w: %s left, stopped before migration %s", ErrTimeBudgetExceeded, left.Round(time.Millisecond), next.Id)
+	}
+	return nil
+}
+
+// Checks if the error was caused by the database connection going away.
+func isConnectionLost(db Queryer, err error) bool {
+	if conn, ok := db.(interface{ IsClosed() bool }); ok && conn.IsClosed() {
+		return true
+	}
+	// Connections of a *pgxpool.Pool, and transactions.
+	if conn, ok := db.(interface{ Conn() *pgx.Conn }); ok && conn.Conn() != nil && conn.Conn().IsClosed() {
+		return true
+	}
+
+	// Class 08 is connection exception, 57P01 to 57P03 are server shutdowns.
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P")
+	}
+
+	return false
+}
+
 // Set the name of the table used to store migration info.
 //
 // Should be called before any other call such as (Exec, ExecMax, ...).
@@ -101,6 +708,11 @@ func SetTable(name string) {
 	}
 }
 
+// SetSchema sets the name of a schema that the migration table be referenced.
+func SetSchema(name string) {
+	migSet.SchemaName = name
+}
+
 // SetDisableCreateTable sets the boolean to disable the creation of the migration table
 func SetDisableCreateTable(disable bool) {
 	migSet.DisableCreateTable = disable
@@ -109,18 +721,84 @@ func SetDisableCreateTable(disable bool) {
 // SetIgnoreUnknown sets the flag that skips database check to see if there is a
 // migration in the database that is not in migration source.
 //
-// This should be used sparingly as it is removing a safety check.
+// This should be used sparingly as it is removing a safety check. It applies
+// to every caller of the package functions: to skip the check for a single
+// call, set IgnoreUnknown on a copy from DefaultMigrationSet instead.
 func SetIgnoreUnknown(v bool) {
 	migSet.IgnoreUnknown = v
 }
 
 type Migration struct {
-	Id   string
+	Id string
+	// Up and Down are the statements of each direction. They are executed
+	// verbatim, one by one: only migration files are parsed and split into
+	// statements. They are sent with the simple protocol, so they are never
+	// prepared nor cached by the server.
 	Up   []string
 	Down []string
 
 	DisableTransactionUp   bool
 	DisableTransactionDown bool
+
+	// Requires lists the database features the migration depends on.
+	Requires []Requirement
+
+	// ParallelGroup names the group of migrations this one can be applied
+	// concurrently with. See the parallel-group annotation.
+	ParallelGroup string
+
+	// Irreversible marks a migration which must never be reverted, declared
+	// with the '-- +migrate irreversible' annotation. Planning Down past it
+	// fails.
+	Irreversible bool
+
+	// ContinueOnError runs each statement in a savepoint, declared with the
+	// '-- +migrate continueOnError' annotation. A failed statement is rolled
+	// back to its savepoint and the next ones still run: the migration is
+	// recorded as applied, and the errors are only reported as warnings.
+	// This is meant for best-effort, idempotent data fixes, and is risky
+	// anywhere else as the migration may be recorded as applied while doing
+	// nothing. It cannot be combined with notransaction.
+	ContinueOnError bool
+
+	// Tags are free-form labels of the migration, such as set by a
+	// ManifestMigrationSource, for example to select migrations with a
+	// FilteredMigrationSource.
+	Tags []string
+
+	// Timeout bounds each statement of the migration, through the
+	// statement_timeout setting. Defaults to the setting of the session.
+	Timeout time.Duration
+
+	// Replaces lists the Ids of the migrations this one replaced in the
+	// source, such as a baseline, declared with the
+	// '-- +migrate replaces <id>...' annotation. Once all of them are
+	// recorded as applied, the migration is considered applied instead of
+	// them, and planning fails if only some of them are.
+	Replaces []string
+
+	// stream is set for migrations whose statements are not held in Up and
+	// Down, see FileMigrationSource.StreamThreshold.
+	stream *migrationStream
+}
+
+const (
+	// RequirementExtension is satisfied when the named extension is installed.
+	RequirementExtension = "extension"
+	// RequirementVersion is satisfied when the server version is at least the
+	// given one, such as "14" or "9.6".
+	RequirementVersion = "version"
+)
+
+// Requirement is a database feature a migration depends on, declared with a
+// '-- +migrate requires <kind> <value>' annotation.
+type Requirement struct {
+	Kind  string
+	Value string
+}
+
+func (r Requirement) String() string {
+	return r.Kind + " " + r.Value
 }
 
 func (m Migration) Less(other *Migration) bool {
@@ -136,8 +814,91 @@ func (m Migration) Less(other *Migration) bool {
 	}
 }
 
+// IsOrdered reports whether the Ids are strictly increasing under Less, the
+// order migrations are applied in. Otherwise it returns the first pair of
+// consecutive Ids out of order. It lets teams check in a unit test that their
+// naming scheme sorts as they expect.
+func IsOrdered(ids []string) (ordered bool, conflictA, conflictB string) {
+	for i := 1; i < len(ids); i++ {
+		if !(&Migration{Id: ids[i-1]}).Less(&Migration{Id: ids[i]}) {
+			return false, ids[i-1], ids[i]
+		}
+	}
+	return true, "", ""
+}
+
+// Checksum returns a digest of the Up and Down statements of the migration,
+// used to detect migrations changed after being applied.
+func (m Migration) Checksum() string {
+	if m.stream != nil {
+		return m.stream.checksum
+	}
+	h := sha256.New()
+	for _, stmts := range [][]string{m.Up, m.Down} {
+		fmt.Fprintf(h, "%d\n", len(stmts))
+		for _, stmt := range stmts {
+			fmt.Fprintf(h, "%d\n%s", len(stmt), stmt)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the number of statements of the direction, without reading the ones
+// of streamed migrations.
+func (m Migration) statementCount(dir MigrationDirection) int {
+	switch {
+	case m.stream != nil && dir == Up:
+		return m.stream.up
+	case m.stream != nil:
+		return m.stream.down
+	case dir == Up:
+		return len(m.Up)
+	default:
+		return len(m.Down)
+	}
+}
+
+// Reports whether the direction has statements.
+func (m Migration) hasStatements(dir MigrationDirection) bool {
+	switch {
+	case m.stream != nil && dir == Up:
+		return m.stream.hasUp
+	case m.stream != nil:
+		return m.stream.hasDown
+	case dir == Up:
+		return hasStatements(m.Up)
+	default:
+		return hasStatements(m.Down)
+	}
+}
+
+// Returns the first statement of the direction controlling the transaction,
+// or an empty string, without reading the ones of streamed migrations.
+func (m Migration) transactionControl(dir MigrationDirection) string {
+	switch {
+	case m.stream != nil && dir == Up:
+		return m.stream.txControlUp
+	case m.stream != nil:
+		return m.stream.txControlDown
+	case dir == Up:
+		return transactionControl(m.Up)
+	default:
+		return transactionControl(m.Down)
+	}
+}
+
 func (m Migration) isNumeric() bool {
-	return len(m.NumberPrefixMatches()) > 0
+	return numberPrefix(m.Id) != ""
+}
+
+// Returns the leading digits of the Id, like numberPrefixRegex but cheaper, as
+// it is used by every comparison of migrations.
+func numberPrefix(id string) string {
+	i := 0
+	for i < len(id) && id[i] >= '0' && id[i] <= '9' {
+		i++
+	}
+	return id[:i]
 }
 
 func (m Migration) NumberPrefixMatches() []string {
@@ -145,7 +906,7 @@ func (m Migration) NumberPrefixMatches() []string {
 }
 
 func (m Migration) VersionInt() int64 {
-	v := m.NumberPrefixMatches()[1]
+	v := numberPrefix(m.Id)
 	value, err := strconv.ParseInt(v, 10, 64)
 	if err != nil {
 		panic(fmt.Sprintf("Could not parse %q into int64: %s", v, err))
@@ -158,6 +919,50 @@ type PlannedMigration struct {
 
 	DisableTransaction bool
 	Queries            []string
+
+	// up is set when the migration is planned Up, which tells the direction
+	// of the statements of streamed migrations.
+	up bool
+	// catchup is set for migrations applied Up to fill a hole in the
+	// applied migrations, whatever the direction of the plan.
+	catchup bool
+	// warnings are the errors of the statements skipped when it was last
+	// applied, see Migration.ContinueOnError.
+	warnings []error
+}
+
+// Calls fn with each query to execute, in order, reading the ones of streamed
+// migrations from their file.
+func (pm *PlannedMigration) eachQuery(fn func(i int, query string) error) error {
+	if pm.stream == nil {
+		for i, query := range pm.Queries {
+			if err := fn(i, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	i := 0
+	_, err := pm.stream.parse(func(up bool, query string) error {
+		if up != pm.up {
+			return nil
+		}
+		i++
+		return fn(i-1, query)
+	})
+	return err
+}
+
+// Reports whether the migration has queries to execute.
+func (pm *PlannedMigration) hasQueries() bool {
+	if pm.stream == nil {
+		return hasStatements(pm.Queries)
+	}
+	if pm.up {
+		return pm.Migration.hasStatements(Up)
+	}
+	return pm.Migration.hasStatements(Down)
 }
 
 type byId []*Migration
@@ -169,6 +974,29 @@ func (b byId) Less(i, j int) bool { return b[i].Less(b[j]) }
 type MigrationRecord struct {
 	Id        string    `db:"id"`
 	AppliedAt time.Time `db:"applied_at"`
+	// ApplySeq increases with every applied migration. Unlike AppliedAt it is
+	// not subject to clock skew or timestamp resolution, so it orders records
+	// by application deterministically.
+	ApplySeq int64 `db:"apply_seq"`
+	// Checksum of the migration when it was applied, empty for migrations
+	// applied by earlier versions.
+	Checksum string `db:"checksum"`
+	// AppliedBy and Hostname are only set for migrations applied with
+	// MigrationSet.RecordProvenance.
+	AppliedBy string `db:"applied_by"`
+	Hostname  string `db:"hostname"`
+	// Statements is the number of Up statements of the migration when it
+	// was applied, zero for migrations applied by earlier versions.
+	Statements int `db:"statements"`
+	// Dirty is set while a notransaction migration is being applied or
+	// reverted, and stays set if it was interrupted. See DirtyError.
+	Dirty bool `db:"dirty"`
+	// Duration is how long the migration took to apply, only set for
+	// migrations applied with MigrationSet.RecordDuration.
+	Duration time.Duration `db:"duration_ms"`
+	// RunId identifies the execution which applied the migration, only set
+	// for migrations applied with MigrationSet.RecordRunId.
+	RunId string `db:"run_id"`
 }
 
 type MigrationSource interface {
@@ -199,108 +1027,430 @@ func (m MemoryMigrationSource) FindMigrations() ([]*Migration, error) {
 
 type HttpFileSystemMigrationSource struct {
 	FileSystem http.FileSystem
+
+	// Extensions of the files to load as migrations. Defaults to ".sql".
+	Extensions []string
+
+	// StreamThreshold is the size in bytes above which files are streamed,
+	// see FileMigrationSource.StreamThreshold.
+	StreamThreshold int64
 }
 
 var _ MigrationSource = (*HttpFileSystemMigrationSource)(nil)
 
 func (f HttpFileSystemMigrationSource) FindMigrations() ([]*Migration, error) {
-	return findMigrations(f.FileSystem, "/")
+	return findMigrations(f.FileSystem, "/", f.Extensions, f.StreamThreshold)
 }
 
 // A set of migrations loaded from a directory.
 type FileMigrationSource struct {
 	Dir string
+
+	// Extensions of the files to load as migrations. Defaults to ".sql".
+	Extensions []string
+
+	// StreamThreshold is the size in bytes above which files are streamed:
+	// their statements are not held in memory, but read from the file and
+	// executed one by one whenever the migration is applied. Such
+	// migrations have no Up and Down, and cannot be squashed. Defaults to
+	// loading all files in memory.
+	StreamThreshold int64
 }
 
 var _ MigrationSource = (*FileMigrationSource)(nil)
 
 func (f FileMigrationSource) FindMigrations() ([]*Migration, error) {
 	filesystem := http.Dir(f.Dir)
-	return findMigrations(filesystem, "/")
+	return findMigrations(filesystem, "/", f.Extensions, f.StreamThreshold)
 }
 
-func findMigrations(dir http.FileSystem, root string) ([]*Migration, error) {
-	migrations := make([]*Migration, 0)
+// Watcher reports changes to the files of directories, for a
+// WatchMigrationSource. It keeps this package free of a dependency on a file
+// notification library. An fsnotify.Watcher can be adapted with:
+//
+//	type watcher struct{ *fsnotify.Watcher }
+//
+//	func (w watcher) Changed() <-chan struct{} {
+//		changed := make(chan struct{})
+//		go func() {
+//			defer close(changed)
+//			for range w.Events {
+//				changed <- struct{}{}
+//			}
+//		}()
+//		return changed
+//	}
+type Watcher interface {
+	// Add starts watching the directory.
+	Add(dir string) error
+	// Changed returns a channel receiving a value for each change to the
+	// watched directories, and closed once the Watcher is closed. It is
+	// called once.
+	Changed() <-chan struct{}
+	Close() error
+}
 
-	file, err := dir.Open(root)
+// A set of migrations loaded from a directory which is watched for changes,
+// so that migrations added during development can be applied without a
+// restart. It is meant for development only.
+//
+// The directory is read again whenever the Watcher reports a change, and
+// Available receives a value when the migrations changed: the application can
+// then call Exec again. FindMigrations returns the migrations of the last
+// successful read, so that a file saved halfway doesn't fail executions.
+type WatchMigrationSource struct {
+	source    FileMigrationSource
+	watcher   Watcher
+	available chan struct{}
+
+	mu         sync.Mutex
+	migrations []*Migration
+}
+
+var _ MigrationSource = (*WatchMigrationSource)(nil)
+
+// NewWatchMigrationSource reads the migrations of source and watches its
+// directory with watcher until Close is called.
+func NewWatchMigrationSource(source FileMigrationSource, watcher Watcher) (*WatchMigrationSource, error) {
+	migrations, err := source.FindMigrations()
 	if err != nil {
 		return nil, err
 	}
+	if err := watcher.Add(source.Dir); err != nil {
+		return nil, fmt.Errorf("failed to watch migration directory %s: %w", source.Dir, err)
+	}
 
-	files, err := file.Readdir(0)
-	if err != nil {
-		return nil, err
+	w := &WatchMigrationSource{
+		source:     source,
+		watcher:    watcher,
+		available:  make(chan struct{}, 1),
+		migrations: migrations,
 	}
+	go w.watch(watcher.Changed())
+	return w, nil
+}
 
-	for _, info := range files {
-		if strings.HasSuffix(info.Name(), ".sql") {
-			migration, err := migrationFromFile(dir, root, info)
-			if err != nil {
-				return nil, err
-			}
+func (w *WatchMigrationSource) FindMigrations() ([]*Migration, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.migrations, nil
+}
 
-			migrations = append(migrations, migration)
+// Available receives a value when the migrations changed since the last one
+// was received. Changes in between are coalesced.
+func (w *WatchMigrationSource) Available() <-chan struct{} {
+	return w.available
+}
+
+// Close stops watching the directory.
+func (w *WatchMigrationSource) Close() error {
+	return w.watcher.Close()
+}
+
+// Reads the directory again on each change, until changed is closed.
+func (w *WatchMigrationSource) watch(changed <-chan struct{}) {
+	for range changed {
+		migrations, err := w.source.FindMigrations()
+		if err != nil {
+			continue
 		}
-	}
 
-	// Make sure migrations are sorted
-	sort.Sort(byId(migrations))
+		w.mu.Lock()
+		modified := !sameMigrations(w.migrations, migrations)
+		w.migrations = migrations
+		w.mu.Unlock()
 
-	return migrations, nil
+		if modified {
+			select {
+			case w.available <- struct{}{}:
+			default:
+			}
+		}
+	}
 }
 
-func migrationFromFile(dir http.FileSystem, root string, info os.FileInfo) (*Migration, error) {
-	path := path.Join(root, info.Name())
-	file, err := dir.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("Error while opening %s: %s", info.Name(), err)
+// Reports whether the migrations have the same Ids and checksums.
+func sameMigrations(a, b []*Migration) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	defer func() { _ = file.Close() }()
-
-	migration, err := ParseMigration(info.Name(), file)
-	if err != nil {
-		return nil, fmt.Errorf("Error while parsing %s: %s", info.Name(), err)
+	for i := range a {
+		if a[i].Id != b[i].Id || a[i].Checksum() != b[i].Checksum() {
+			return false
+		}
 	}
-	return migration, nil
+	return true
 }
 
-// Migrations from a bindata asset set.
-type AssetMigrationSource struct {
-	// Asset should return content of file in path if exists
-	Asset func(path string) ([]byte, error)
-
-	// AssetDir should return list of files in the path
-	AssetDir func(path string) ([]string, error)
-
-	// Path in the bindata to use.
+// A set of migrations loaded from a directory, where a file can bundle several
+// migrations. Each of them starts with a '-- +migrate-file <id>' header,
+// followed by its Up and Down sections, and is recorded on its own. Files
+// without headers are loaded as a single migration, as FileMigrationSource
+// does.
+type MultiMigrationFileSource struct {
 	Dir string
-}
 
-var _ MigrationSource = (*AssetMigrationSource)(nil)
+	// Extensions of the files to load as migrations. Defaults to ".sql".
+	Extensions []string
+}
 
-func (a AssetMigrationSource) FindMigrations() ([]*Migration, error) {
-	migrations := make([]*Migration, 0)
+var _ MigrationSource = (*MultiMigrationFileSource)(nil)
 
-	files, err := a.AssetDir(a.Dir)
+func (f MultiMigrationFileSource) FindMigrations() ([]*Migration, error) {
+	entries, err := os.ReadDir(f.Dir)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, name := range files {
-		if strings.HasSuffix(name, ".sql") {
-			file, err := a.Asset(path.Join(a.Dir, name))
-			if err != nil {
-				return nil, err
-			}
-
-			migration, err := ParseMigration(name, bytes.NewReader(file))
-			if err != nil {
-				return nil, err
+	// Report all the files which can't be parsed at once.
+	var migrations []*Migration
+	var errs []error
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !hasExtension(entry.Name(), f.Extensions) {
+			continue
+		}
+		found, err := migrationsFromMultiFile(filepath.Join(f.Dir, entry.Name()), entry.Name())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, migration := range found {
+			if other, ok := files[migration.Id]; ok {
+				errs = append(errs, fmt.Errorf("Migration %s is declared in both %s and %s", migration.Id, other, entry.Name()))
+				continue
 			}
-
+			files[migration.Id] = entry.Name()
 			migrations = append(migrations, migration)
 		}
 	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	sort.Sort(byId(migrations))
+	return migrations, nil
+}
+
+// Parses the migrations declared in the file, or the file as a single
+// migration if it has no '-- +migrate-file' header.
+func migrationsFromMultiFile(filename, name string) ([]*Migration, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %s: %s", name, err)
+	}
+	sections, err := sqlparse.SplitMigrationFile(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %s: %s", name, err)
+	}
+	if len(sections) == 0 {
+		migration, err := ParseMigration(name, bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing %s: %s", name, err)
+		}
+		return []*Migration{migration}, nil
+	}
+
+	migrations := make([]*Migration, 0, len(sections))
+	for _, section := range sections {
+		migration, err := ParseMigration(section.Id, strings.NewReader(section.Body))
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing %s: %s", name, err)
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+var defaultExtensions = []string{".sql"}
+
+// Checks if the file name has one of the extensions, or the default ones if
+// none are given.
+func hasExtension(name string, extensions []string) bool {
+	if len(extensions) == 0 {
+		extensions = defaultExtensions
+	}
+	for _, ext := range extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func findMigrations(dir http.FileSystem, root string, extensions []string, streamThreshold int64) ([]*Migration, error) {
+	migrations := make([]*Migration, 0)
+
+	file, err := dir.Open(root)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := file.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report all the migrations which can't be parsed at once.
+	var errs []error
+	for _, info := range files {
+		if hasExtension(info.Name(), extensions) {
+			migration, err := migrationFromFile(dir, root, info, streamThreshold)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			migrations = append(migrations, migration)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// Make sure migrations are sorted
+	sort.Sort(byId(migrations))
+
+	return migrations, nil
+}
+
+func migrationFromFile(dir http.FileSystem, root string, info os.FileInfo, streamThreshold int64) (*Migration, error) {
+	path := path.Join(root, info.Name())
+	if streamThreshold > 0 && info.Size() > streamThreshold {
+		migration, err := streamMigration(info.Name(), func() (io.ReadCloser, error) { return dir.Open(path) })
+		if err != nil {
+			return nil, fmt.Errorf("Error while parsing %s: %s", info.Name(), err)
+		}
+		return migration, nil
+	}
+
+	file, err := dir.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %s: %s", info.Name(), err)
+	}
+	defer func() { _ = file.Close() }()
+
+	migration, err := ParseMigration(info.Name(), file)
+	if err != nil {
+		return nil, fmt.Errorf("Error while parsing %s: %s", info.Name(), err)
+	}
+	return migration, nil
+}
+
+// A set of migrations loaded from a directory, where files ending in ".tmpl"
+// are rendered with text/template before being parsed. The Id of a rendered
+// migration is its file name without the ".tmpl" suffix, so "1_init.sql.tmpl"
+// becomes "1_init.sql". Other files are loaded unchanged.
+type TemplateFileMigrationSource struct {
+	Dir string
+
+	// Data is passed to the templates when rendering them.
+	Data any
+
+	// Extensions of the files to load as migrations, before the ".tmpl"
+	// suffix. Defaults to ".sql".
+	Extensions []string
+}
+
+var _ MigrationSource = (*TemplateFileMigrationSource)(nil)
+
+const templateExtension = ".tmpl"
+
+func (f TemplateFileMigrationSource) FindMigrations() ([]*Migration, error) {
+	migrations := make([]*Migration, 0)
+
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), templateExtension)
+		if entry.IsDir() || !hasExtension(id, f.Extensions) {
+			continue
+		}
+
+		content, err := os.ReadFile(path.Join(f.Dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Error while reading %s: %s", entry.Name(), err)
+		}
+
+		if id != entry.Name() {
+			tmpl, err := template.New(entry.Name()).Parse(string(content))
+			if err != nil {
+				return nil, fmt.Errorf("Error while parsing template %s: %s", entry.Name(), err)
+			}
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, f.Data); err != nil {
+				return nil, fmt.Errorf("Error while rendering template %s: %s", entry.Name(), err)
+			}
+			content = buf.Bytes()
+		}
+
+		migration, err := ParseMigration(id, bytes.NewReader(content))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		migrations = append(migrations, migration)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// Make sure migrations are sorted
+	sort.Sort(byId(migrations))
+
+	return migrations, nil
+}
+
+// Migrations from a bindata asset set.
+type AssetMigrationSource struct {
+	// Asset should return content of file in path if exists
+	Asset func(path string) ([]byte, error)
+
+	// AssetDir should return list of files in the path
+	AssetDir func(path string) ([]string, error)
+
+	// Path in the bindata to use.
+	Dir string
+
+	// Extensions of the files to load as migrations. Defaults to ".sql".
+	Extensions []string
+}
+
+var _ MigrationSource = (*AssetMigrationSource)(nil)
+
+func (a AssetMigrationSource) FindMigrations() ([]*Migration, error) {
+	migrations := make([]*Migration, 0)
+
+	files, err := a.AssetDir(a.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, name := range files {
+		if hasExtension(name, a.Extensions) {
+			file, err := a.Asset(path.Join(a.Dir, name))
+			if err != nil {
+				return nil, err
+			}
+
+			migration, err := ParseMigration(name, bytes.NewReader(file))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			migrations = append(migrations, migration)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
 
 	// Make sure migrations are sorted
 	sort.Sort(byId(migrations))
@@ -308,6 +1458,284 @@ func (a AssetMigrationSource) FindMigrations() ([]*Migration, error) {
 	return migrations, nil
 }
 
+// TreeReader reads files from a tree of directories, such as a commit of a git
+// repository, without requiring it to be checked out.
+type TreeReader interface {
+	// ReadFile returns the content of the file at path.
+	ReadFile(path string) ([]byte, error)
+	// ReadDir returns the names of the entries of the directory at path.
+	ReadDir(path string) ([]string, error)
+}
+
+// Migrations from a directory of a TreeReader. With go-git, a TreeReader can be
+// implemented on top of the *object.Tree of a commit.
+type TreeMigrationSource struct {
+	Tree TreeReader
+
+	// Path of the migrations directory in the tree.
+	Dir string
+
+	// Extensions of the files to load as migrations. Defaults to ".sql".
+	Extensions []string
+}
+
+var _ MigrationSource = (*TreeMigrationSource)(nil)
+
+func (t TreeMigrationSource) FindMigrations() ([]*Migration, error) {
+	return AssetMigrationSource{
+		Asset:      t.Tree.ReadFile,
+		AssetDir:   t.Tree.ReadDir,
+		Dir:        t.Dir,
+		Extensions: t.Extensions,
+	}.FindMigrations()
+}
+
+// Migrations of another source passing a predicate. Filtered out migrations
+// are invisible to planning, as if they were not in the source.
+type FilteredMigrationSource struct {
+	Source MigrationSource
+
+	// Keep reports whether the migration is part of the source.
+	Keep func(m *Migration) bool
+}
+
+var _ MigrationSource = (*FilteredMigrationSource)(nil)
+
+// FilterMigrationSource returns the migrations of inner for which keep is true.
+func FilterMigrationSource(inner MigrationSource, keep func(m *Migration) bool) *FilteredMigrationSource {
+	return &FilteredMigrationSource{Source: inner, Keep: keep}
+}
+
+func (f FilteredMigrationSource) FindMigrations() ([]*Migration, error) {
+	return f.find(true)
+}
+
+// Returns the migrations of the source not passing the predicate.
+func (f FilteredMigrationSource) filteredOut() ([]*Migration, error) {
+	return f.find(false)
+}
+
+// Returns the migrations of the source for which Keep returns keep.
+func (f FilteredMigrationSource) find(keep bool) ([]*Migration, error) {
+	migrations, err := f.Source.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]*Migration, 0, len(migrations))
+	for _, migration := range migrations {
+		if f.Keep(migration) == keep {
+			found = append(found, migration)
+		}
+	}
+	return found, nil
+}
+
+// Migrations of another source with options set by a JSON manifest, for teams
+// preferring a single manifest over annotations in each migration file. The
+// manifest maps migration Ids to their options:
+//
+//	{
+//		"3_people_index.sql": {"notransaction": true, "timeout": "10m"},
+//		"4_drop_legacy.sql": {"irreversible": true, "tags": ["cleanup"]}
+//	}
+//
+// Options can only be enabled: the annotations of a migration still apply.
+// Finding migrations fails if the manifest references an unknown Id or option.
+type ManifestMigrationSource struct {
+	Source MigrationSource
+
+	// Path is the manifest file, such as migrations.manifest.json in the
+	// migrations directory.
+	Path string
+}
+
+var _ MigrationSource = (*ManifestMigrationSource)(nil)
+
+// ManifestOptions are the options of a migration in the manifest of a
+// ManifestMigrationSource.
+type ManifestOptions struct {
+	// NoTransaction runs both directions outside of a transaction, as the
+	// notransaction annotation.
+	NoTransaction   bool     `json:"notransaction"`
+	Irreversible    bool     `json:"irreversible"`
+	ContinueOnError bool     `json:"continueOnError"`
+	Tags            []string `json:"tags"`
+	// Timeout is a duration parsed by time.ParseDuration, see
+	// Migration.Timeout.
+	Timeout string `json:"timeout"`
+}
+
+func (m ManifestMigrationSource) FindMigrations() ([]*Migration, error) {
+	data, err := os.ReadFile(m.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration manifest: %w", err)
+	}
+	var manifest map[string]ManifestOptions
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse migration manifest %s: %w", m.Path, err)
+	}
+
+	migrations, err := m.Source.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Migration, 0, len(migrations))
+	found := make(map[string]struct{}, len(manifest))
+	for _, migration := range migrations {
+		options, ok := manifest[migration.Id]
+		if !ok {
+			result = append(result, migration)
+			continue
+		}
+		found[migration.Id] = struct{}{}
+
+		// Leave the migrations of the source untouched.
+		configured := *migration
+		if options.NoTransaction {
+			configured.DisableTransactionUp = true
+			configured.DisableTransactionDown = true
+		}
+		configured.Irreversible = configured.Irreversible || options.Irreversible
+		configured.ContinueOnError = configured.ContinueOnError || options.ContinueOnError
+		configured.Tags = append(append([]string(nil), configured.Tags...), options.Tags...)
+		if options.Timeout != "" {
+			if configured.Timeout, err = time.ParseDuration(options.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout of migration %s in manifest %s: %w", migration.Id, m.Path, err)
+			}
+		}
+		result = append(result, &configured)
+	}
+
+	for _, id := range sortedKeys(manifest) {
+		if _, ok := found[id]; !ok {
+			return nil, fmt.Errorf("migration manifest %s references unknown migration %s", m.Path, id)
+		}
+	}
+
+	return result, nil
+}
+
+// Migrations of several sources, such as production migrations overlaid with
+// test-specific ones. When sources have migrations with the same Id, the one
+// of the last source wins, unless RejectDuplicates is set.
+type CombinedMigrationSource struct {
+	Sources []MigrationSource
+
+	// RejectDuplicates makes FindMigrations fail when several sources have a
+	// migration with the same Id, instead of keeping the last one.
+	RejectDuplicates bool
+}
+
+var _ MigrationSource = (*CombinedMigrationSource)(nil)
+
+// CombineMigrationSources returns the migrations of all sources, the later
+// sources overriding the earlier ones.
+func CombineMigrationSources(sources ...MigrationSource) *CombinedMigrationSource {
+	return &CombinedMigrationSource{Sources: sources}
+}
+
+func (c CombinedMigrationSource) FindMigrations() ([]*Migration, error) {
+	found := make(map[string]*Migration)
+	for _, source := range c.Sources {
+		migrations, err := source.FindMigrations()
+		if err != nil {
+			return nil, err
+		}
+		for _, migration := range migrations {
+			if _, ok := found[migration.Id]; ok && c.RejectDuplicates {
+				return nil, fmt.Errorf("migration %s is provided by several sources", migration.Id)
+			}
+			found[migration.Id] = migration
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(found))
+	for _, migration := range found {
+		migrations = append(migrations, migration)
+	}
+	sort.Sort(byId(migrations))
+	return migrations, nil
+}
+
+// DuplicatePrefixPolicy is the policy applied to migrations sharing the same
+// numeric prefix.
+type DuplicatePrefixPolicy int
+
+const (
+	// AllowDuplicatePrefix orders migrations with the same numeric prefix by
+	// the rest of their Id.
+	AllowDuplicatePrefix DuplicatePrefixPolicy = iota
+	// ErrorDuplicatePrefix rejects migrations with the same numeric prefix,
+	// which typically collided when merging concurrent changes.
+	ErrorDuplicatePrefix
+)
+
+// IdScheme is a naming scheme for migration Ids, see NextId.
+type IdScheme int
+
+const (
+	// SequentialIds numbers migrations with increasing integers, zero-padded
+	// to the width of the existing ones.
+	SequentialIds IdScheme = iota
+	// TimestampIds names migrations after the current UTC time, formatted as
+	// YYYYMMDDhhmmss.
+	TimestampIds
+)
+
+const timestampIdFormat = "20060102150405"
+
+// NextId returns the Id prefix of the next migration to add to the source,
+// following the given scheme. The returned Id sorts after all the migrations
+// of the source.
+func NextId(m MigrationSource, scheme IdScheme) (string, error) {
+	return migSet.NextId(m, scheme)
+}
+
+// NextId returns the next Id as derived by the IdPattern, if set, which is
+// then the part of the name of the next migration captured by the pattern.
+func (ms MigrationSet) NextId(m MigrationSource, scheme IdScheme) (string, error) {
+	migrations, err := m.FindMigrations()
+	if err != nil {
+		return "", err
+	}
+	migrations, errs := ms.applyIdPattern(migrations)
+	if len(errs) > 0 {
+		return "", errs[0]
+	}
+
+	var last *Migration
+	if len(migrations) > 0 {
+		last = migrations[len(migrations)-1]
+	}
+
+	var next string
+	switch scheme {
+	case SequentialIds:
+		next = "1"
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if migrations[i].isNumeric() {
+				width := len(migrations[i].NumberPrefixMatches()[1])
+				next = fmt.Sprintf("%0*d", width, migrations[i].VersionInt()+1)
+				break
+			}
+		}
+	case TimestampIds:
+		next = time.Now().UTC().Format(timestampIdFormat)
+	default:
+		return "", fmt.Errorf("unknown migration id scheme %d", scheme)
+	}
+
+	if last != nil && !last.Less(&Migration{Id: next}) {
+		return "", fmt.Errorf("next migration id %s would not sort after %s", next, last.Id)
+	}
+
+	return next, nil
+}
+
 // Avoids pulling in the packr library for everyone, mimicks the bits of
 // packr.Box that we need.
 type PackrBox interface {
@@ -317,325 +1745,3352 @@ type PackrBox interface {
 
 // Migration parsing
 func ParseMigration(id string, r io.ReadSeeker) (*Migration, error) {
-	m := &Migration{
-		Id: id,
+	parsed, err := sqlparse.ParseMigration(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing migration (%s): %s", id, err)
+	}
+
+	return newMigration(id, parsed), nil
+}
+
+// ParseMigrationFile parses a single migration file, as sources do when
+// loading a directory, such as to inspect it in tooling. The Id of the
+// migration is the name of the file.
+func ParseMigrationFile(path string) (*Migration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error while opening %s: %s", path, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	return ParseMigration(filepath.Base(path), file)
+}
+
+// Returns the migration of the parsed file.
+func newMigration(id string, parsed *sqlparse.ParsedMigration) *Migration {
+	m := &Migration{
+		Id: id,
+	}
+
+	m.Up = parsed.UpStatements
+	m.Down = parsed.DownStatements
+
+	m.DisableTransactionUp = parsed.DisableTransactionUp
+	m.DisableTransactionDown = parsed.DisableTransactionDown
+
+	for _, r := range parsed.Requirements {
+		m.Requires = append(m.Requires, Requirement{Kind: r.Kind, Value: r.Value})
+	}
+
+	m.ParallelGroup = parsed.ParallelGroup
+	m.Irreversible = parsed.Irreversible
+	m.ContinueOnError = parsed.ContinueOnError
+	m.Replaces = parsed.Replaces
+
+	return m
+}
+
+// Statements of a migration too large to be held in memory, read from its file
+// whenever they are needed.
+type migrationStream struct {
+	open     func() (io.ReadCloser, error)
+	up, down int
+	checksum string
+
+	// Found while counting the statements, so that checkMigrations doesn't
+	// read the file again.
+	hasUp, hasDown             bool
+	txControlUp, txControlDown string
+}
+
+// Parses the file, calling fn with each statement.
+func (s *migrationStream) parse(fn func(up bool, stmt string) error) (*sqlparse.ParsedMigration, error) {
+	r, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	return sqlparse.ParseMigrationStream(r, fn)
+}
+
+// Parses the migration of the file without holding its statements in memory.
+// The file is read once to count the statements and once per direction to
+// compute the same checksum as if it was loaded in memory.
+func streamMigration(id string, open func() (io.ReadCloser, error)) (*Migration, error) {
+	stream := &migrationStream{open: open}
+	parsed, err := stream.parse(func(up bool, stmt string) error {
+		count, has, txControl := &stream.down, &stream.hasDown, &stream.txControlDown
+		if up {
+			count, has, txControl = &stream.up, &stream.hasUp, &stream.txControlUp
+		}
+		*count++
+		*has = *has || strings.TrimSpace(stmt) != ""
+		if *txControl == "" {
+			*txControl = transactionControl([]string{stmt})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	for _, count := range []struct {
+		up bool
+		n  int
+	}{{true, stream.up}, {false, stream.down}} {
+		fmt.Fprintf(h, "%d\n", count.n)
+		_, err := stream.parse(func(up bool, stmt string) error {
+			if up == count.up {
+				fmt.Fprintf(h, "%d\n%s", len(stmt), stmt)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	stream.checksum = hex.EncodeToString(h.Sum(nil))
+
+	m := newMigration(id, parsed)
+	m.stream = stream
+	return m, nil
+}
+
+// Execute a set of migrations
+//
+// Returns the number of applied migrations. The statements skipped by
+// continueOnError migrations are only logged, ExecMaxResult also returns them.
+func Exec(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) (int, error) {
+	return ExecMax(ctx, db, m, dir, 0)
+}
+
+// Returns the number of applied migrations.
+func (ms MigrationSet) Exec(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) (int, error) {
+	return ms.ExecMax(ctx, db, m, dir, 0)
+}
+
+// Execute a set of migrations
+//
+// Will apply at most `max` migrations. Pass 0 for no limit (or use Exec).
+//
+// Returns the number of applied migrations. The statements skipped by
+// continueOnError migrations are only logged, ExecMaxResult also returns them.
+func ExecMax(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, max int) (int, error) {
+	return migSet.ExecMax(ctx, db, m, dir, max)
+}
+
+// Execute a set of migrations
+//
+// Will apply at the target `version` of migration. Cannot be a negative value.
+//
+// Returns the number of applied migrations.
+func ExecVersion(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, version int64) (int, error) {
+	if version < 0 {
+		return 0, fmt.Errorf("target version %d should not be negative", version)
+	}
+	return migSet.ExecVersion(ctx, db, m, dir, version)
+}
+
+// Execute a set of migrations
+//
+// Will apply only the migrations whose Id falls within the inclusive range
+// [fromId, toId]. Unapplied migrations below fromId are not skipped silently:
+// an error is returned instead.
+//
+// Returns the number of applied migrations.
+func ExecRange(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, fromId, toId string) (int, error) {
+	return migSet.ExecRange(ctx, db, m, dir, fromId, toId)
+}
+
+// Resume an aborted execution from a migration. See MigrationSet.ResumeFrom.
+//
+// Returns the number of applied migrations.
+func ResumeFrom(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, fromId string) (int, error) {
+	return migSet.ResumeFrom(ctx, db, m, dir, fromId)
+}
+
+// Returns the number of applied migrations.
+func (ms MigrationSet) ExecMax(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, max int) (int, error) {
+	return ms.exec(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		return ms.PlanMigration(ctx, conn, m, dir, max)
+	})
+}
+
+// Execute a set of migrations like Exec, returning the planned migrations which
+// were applied, for example to log their Ids and statements.
+func ExecWithPlan(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) ([]*PlannedMigration, error) {
+	return migSet.ExecWithPlan(ctx, db, m, dir)
+}
+
+func (ms MigrationSet) ExecWithPlan(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) ([]*PlannedMigration, error) {
+	return ms.execPlan(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		return ms.PlanMigration(ctx, conn, m, dir, 0)
+	})
+}
+
+// Execute a set of migrations like ExecMax, reporting in the result whether
+// migrations remain pending because `max` was reached.
+func ExecMaxResult(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, max int) (*ExecResult, error) {
+	return migSet.ExecMaxResult(ctx, db, m, dir, max)
+}
+
+func (ms MigrationSet) ExecMaxResult(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, max int) (*ExecResult, error) {
+	moreAvailable := false
+	var skipped []SkippedMigration
+	var runId string
+	applied, err := ms.execPlan(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		runId = ms.RunId
+		migrations, err := ms.PlanMigration(ctx, conn, m, dir, max)
+		if err != nil {
+			return nil, err
+		}
+		skipped, err = ms.skippedMigrations(ctx, conn, m, dir, migrations)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range skipped {
+			if s.Reason == SkippedByLimit {
+				moreAvailable = true
+			}
+		}
+		return migrations, nil
+	})
+	return &ExecResult{Applied: len(applied), MoreAvailable: moreAvailable, Skipped: skipped, RunId: runId, Warnings: appliedWarnings(applied)}, err
+}
+
+// Returns the migrations of the source left out of the plan, and why.
+func (ms MigrationSet) skippedMigrations(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, planned []*PlannedMigration) ([]SkippedMigration, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	records, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if records, err = replaceRecords(migrations, records); err != nil {
+		return nil, err
+	}
+	applied := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		applied[record.Id] = struct{}{}
+	}
+	inPlan := make(map[string]struct{}, len(planned))
+	for _, migration := range planned {
+		inPlan[migration.Id] = struct{}{}
+	}
+
+	var skipped []SkippedMigration
+	for _, migration := range migrations {
+		if _, ok := inPlan[migration.Id]; ok {
+			continue
+		}
+		_, isApplied := applied[migration.Id]
+		reason := SkippedByLimit
+		switch {
+		case dir == Up && isApplied:
+			reason = SkippedAlreadyApplied
+		case dir == Down && !isApplied:
+			reason = SkippedNotApplied
+		}
+		skipped = append(skipped, SkippedMigration{Migration: migration, Reason: reason})
+	}
+
+	if f, ok := m.(interface {
+		filteredOut() ([]*Migration, error)
+	}); ok {
+		filtered, err := f.filteredOut()
+		if err != nil {
+			return nil, err
+		}
+		for _, migration := range filtered {
+			skipped = append(skipped, SkippedMigration{Migration: migration, Reason: SkippedByFilter})
+		}
+	}
+
+	return skipped, nil
+}
+
+// Returns the number of applied migrations.
+func (ms MigrationSet) ExecVersion(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, version int64) (int, error) {
+	return ms.exec(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		return ms.PlanMigrationToVersion(ctx, conn, m, dir, version)
+	})
+}
+
+// Returns the number of applied migrations.
+func (ms MigrationSet) ExecRange(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, fromId, toId string) (int, error) {
+	return ms.exec(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		return ms.PlanMigrationRange(ctx, conn, m, dir, fromId, toId)
+	})
+}
+
+// ResumeFrom applies the pending migrations from fromId onward, in the order
+// of the direction, such as to resume an execution which aborted at fromId.
+//
+// Unlike Exec, it does not pick up migrations left behind before fromId:
+// planning fails if going Up with an unapplied migration below fromId, or
+// going Down with an applied migration above it. fromId must be a migration
+// of the source.
+//
+// Returns the number of applied migrations.
+func (ms MigrationSet) ResumeFrom(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, fromId string) (int, error) {
+	return ms.exec(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		migrations, err := ms.findMigrations(m)
+		if err != nil {
+			return nil, err
+		}
+		planned, err := ms.PlanMigration(ctx, conn, m, dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		return resumePlan(migrations, planned, dir, fromId)
+	})
+}
+
+// Returns the planned migrations from fromId onward, failing if any precedes
+// it.
+func resumePlan(migrations []*Migration, planned []*PlannedMigration, dir MigrationDirection, fromId string) ([]*PlannedMigration, error) {
+	var from *Migration
+	for _, migration := range migrations {
+		if migration.Id == fromId {
+			from = migration
+			break
+		}
+	}
+	if from == nil {
+		return nil, fmt.Errorf("unknown migration %s to resume from", fromId)
+	}
+
+	for _, migration := range planned {
+		switch {
+		case dir == Up && migration.Less(from):
+			return nil, newPlanError(migration.Migration, fmt.Sprintf("unapplied migration below resume point %s", fromId))
+		case dir == Down && from.Less(migration.Migration):
+			return nil, newPlanError(migration.Migration, fmt.Sprintf("applied migration above resume point %s", fromId))
+		}
+	}
+	return planned, nil
+}
+
+// ExecResult describes the outcome of an execution.
+type ExecResult struct {
+	// Applied is the number of applied migrations.
+	Applied int
+	// MoreAvailable reports that the execution stopped at its limit while
+	// more migrations were pending.
+	MoreAvailable bool
+	// Skipped lists the migrations of the source left out of the plan, with
+	// the reason. It is only set by ExecMaxResult.
+	Skipped []SkippedMigration
+	// RunId identifies the execution, see MigrationSet.RunId. It is only
+	// set by ExecMaxResult.
+	RunId string
+	// Warnings are the errors of the statements skipped by the
+	// continueOnError migrations applied, as *StatementError.
+	Warnings []error
+}
+
+// Returns the warnings of the applied migrations, see ExecResult.Warnings.
+func appliedWarnings(applied []*PlannedMigration) []error {
+	var warnings []error
+	for _, migration := range applied {
+		warnings = append(warnings, migration.warnings...)
+	}
+	return warnings
+}
+
+// SkipReason tells why a migration was left out of a plan.
+type SkipReason string
+
+const (
+	// SkippedAlreadyApplied migrations were not applied Up as they already
+	// are.
+	SkippedAlreadyApplied SkipReason = "already-applied"
+	// SkippedNotApplied migrations were not reverted as they are not
+	// applied.
+	SkippedNotApplied SkipReason = "not-applied"
+	// SkippedByLimit migrations were pending, but beyond the maximum number
+	// of migrations of the execution.
+	SkippedByLimit SkipReason = "beyond-limit"
+	// SkippedByFilter migrations were excluded by a FilteredMigrationSource.
+	SkippedByFilter SkipReason = "filtered"
+)
+
+// SkippedMigration is a migration left out of a plan, see ExecResult.Skipped.
+type SkippedMigration struct {
+	Migration *Migration
+	Reason    SkipReason
+}
+
+// MigrationResult is the outcome of applying a single migration. The migration
+// was applied successfully when Err is nil. A result with a nil Migration
+// reports the failure of the execution itself, see ExecStream.
+type MigrationResult struct {
+	Migration *Migration
+	Duration  time.Duration
+	Err       error
+	// Warnings are the errors of the statements skipped by a
+	// continueOnError migration, as *StatementError.
+	Warnings []error
+}
+
+// Execute a set of migrations, streaming their results. See
+// MigrationSet.ExecStream.
+func ExecStream(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) (<-chan MigrationResult, error) {
+	return migSet.ExecStream(ctx, db, m, dir)
+}
+
+// Plans the migrations, then applies them in the background, sending the
+// result of each migration on the returned channel as soon as it completes.
+// The channel is closed once all migrations are applied or after the first
+// failed one. Planning errors are returned directly. With AtomicDown, results
+// are sent once the transaction is committed, or only the one of the failed
+// migration once it is rolled back.
+//
+// Executions can also fail outside of a migration after planning, such as on
+// an ErrTimeBudgetExceeded, a failing AfterAll statement, or the commit of
+// an atomic execution. Their error is then sent as a last result with a nil
+// Migration, so the channel never closes on an unreported failure.
+//
+// The channel must be drained, or ctx cancelled, for the execution to finish
+// and release its connection.
+func (ms MigrationSet) ExecStream(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) (<-chan MigrationResult, error) {
+	results := make(chan MigrationResult)
+	// Migrations applied concurrently report their results concurrently.
+	var mu sync.Mutex
+	reported := false
+	ms.onResult = func(result MigrationResult) {
+		mu.Lock()
+		reported = reported || result.Err != nil
+		mu.Unlock()
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+	}
+
+	planned := make(chan error, 1)
+	go func() {
+		defer close(results)
+		var planErr error
+		plannedCalled := false
+		_, err := ms.exec(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+			plannedCalled = true
+			migrations, err := ms.PlanMigration(ctx, conn, m, dir, 0)
+			planErr = err
+			planned <- err
+			return migrations, err
+		})
+		if !plannedCalled {
+			planned <- err
+			return
+		}
+		if err != nil && planErr == nil && !reported {
+			ms.onResult(MigrationResult{Err: err})
+		}
+	}()
+
+	if err := <-planned; err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Apply all pending migrations with every safety check enabled. See
+// MigrationSet.ExecStrict.
+func ExecStrict(ctx context.Context, db Queryer, m MigrationSource) (*ExecResult, error) {
+	return migSet.ExecStrict(ctx, db, m)
+}
+
+// Applies all pending migrations Up, after checking that no applied migration
+// changed in the source since it was applied and that every applied migration
+// is still in the source, regardless of IgnoreUnknown and OnUnknownMigration.
+// No migration is applied if any of the checks fails, in which case a
+// *DriftError or a *PlanError is returned.
+func (ms MigrationSet) ExecStrict(ctx context.Context, db Queryer, m MigrationSource) (*ExecResult, error) {
+	ms.IgnoreUnknown = false
+	ms.OnUnknownMigration = nil
+	applied, err := ms.execPlan(ctx, db, Up, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		drift, err := ms.drift(ctx, conn, m)
+		if err != nil {
+			return nil, err
+		}
+		if drift != nil {
+			return nil, drift
+		}
+		return ms.PlanMigration(ctx, conn, m, Up, 0)
+	})
+	return &ExecResult{Applied: len(applied), Warnings: appliedWarnings(applied)}, err
+}
+
+// Returns the applied migrations whose checksum in the source differs from the
+// one recorded when they were applied, or nil if there are none.
+func (ms MigrationSet) drift(ctx context.Context, db Queryer, m MigrationSource) (*DriftError, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	records, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]*MigrationRecord, len(records))
+	for _, record := range records {
+		recorded[record.Id] = record
+	}
+
+	drift := &DriftError{}
+	for _, migration := range migrations {
+		record, ok := recorded[migration.Id]
+		if !ok || record.Checksum == "" || record.Checksum == migration.Checksum() {
+			continue
+		}
+		drift.Migrations = append(drift.Migrations, migration)
+		if record.Statements > 0 && migration.statementCount(Up) > record.Statements {
+			drift.Grown = append(drift.Grown, migration)
+		}
+	}
+	if len(drift.Migrations) == 0 {
+		return nil, nil
+	}
+	return drift, nil
+}
+
+// Execute a set of migrations within a transaction which is always rolled
+// back, to check that they would succeed against the real schema.
+//
+// Returns the number of migrations which were applied before the rollback.
+func TryExec(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) (int, error) {
+	return migSet.TryExec(ctx, db, m, dir)
+}
+
+// Applies the migrations within a single outer transaction, each of them in a
+// savepoint, and rolls the outer transaction back whatever the outcome. This
+// surfaces SQL errors that PlanMigration cannot detect without persisting any
+// change. Side effects which are not transactional, such as sequence
+// increments, still happen.
+//
+// Returns the number of migrations which were applied before the rollback.
+func (ms MigrationSet) TryExec(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) (int, error) {
+	applied := 0
+	err := ms.withConn(ctx, db, func(conn Queryer) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to init db transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		migrations, err := ms.PlanMigration(ctx, tx, m, dir, 0)
+		if err != nil {
+			return err
+		}
+
+		appliedMigrations, err := ms.applyMigrations(ctx, tx, nil, dir, migrations)
+		applied = len(appliedMigrations)
+		return err
+	})
+	return applied, err
+}
+
+// Applies all the migrations Up then Down within a single outer transaction,
+// which is always rolled back. See MigrationSet.RunInRollback.
+func RunInRollback(ctx context.Context, db Queryer, m MigrationSource) error {
+	return migSet.RunInRollback(ctx, db, m)
+}
+
+// Applies all the migrations of the source Up, then reverts all of them Down,
+// within a single outer transaction which is rolled back whatever the outcome.
+// Like TryExec, but exercising both directions, which makes it suitable for CI
+// against a database reused across test cases. notransaction migrations fail,
+// as they cannot run in a transaction.
+func (ms MigrationSet) RunInRollback(ctx context.Context, db Queryer, m MigrationSource) error {
+	return ms.withConn(ctx, db, func(conn Queryer) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to init db transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		for _, dir := range []MigrationDirection{Up, Down} {
+			migrations, err := ms.PlanMigration(ctx, tx, m, dir, 0)
+			if err != nil {
+				return err
+			}
+			if _, err := ms.applyMigrations(ctx, tx, nil, dir, migrations); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SchemaSnapshot returns the objects of the schema of a database, mapping
+// their name to their definition, such as "people.first_name": "text". It is
+// given to VerifyReversibleStrict, which only compares snapshots, so it
+// decides which objects matter.
+type SchemaSnapshot func(ctx context.Context, db Queryer) (map[string]string, error)
+
+// Check that the Down of each pending migration reverses its Up, in a
+// transaction which is always rolled back. See
+// MigrationSet.VerifyReversibleStrict.
+func VerifyReversibleStrict(ctx context.Context, db Queryer, m MigrationSource, snapshot SchemaSnapshot) error {
+	return migSet.VerifyReversibleStrict(ctx, db, m, snapshot)
+}
+
+// VerifyReversibleStrict checks that the schema after applying Up then Down
+// of each pending migration is the one before, as captured by snapshot. Like
+// RunInRollback, it runs in a transaction which is always rolled back, so
+// the pending migrations must not disable transactions. Each migration is
+// applied again before checking the next one. Irreversible migrations are
+// only applied.
+//
+// A migration whose Down leaves the schema different, such as with a stray
+// column or index, fails with a *PlanError naming the divergent objects.
+func (ms MigrationSet) VerifyReversibleStrict(ctx context.Context, db Queryer, m MigrationSource, snapshot SchemaSnapshot) error {
+	return ms.withConn(ctx, db, func(conn Queryer) error {
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to init db transaction: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		migrations, err := ms.PlanMigration(ctx, tx, m, Up, 0)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			if migration.Irreversible {
+				if _, err := ms.applyMigrations(ctx, tx, nil, Up, []*PlannedMigration{migration}); err != nil {
+					return err
+				}
+				continue
+			}
+
+			down := newPlannedMigration(migration.Migration, Down)
+			if err := ms.checkRevertible(Down, []*PlannedMigration{down}); err != nil {
+				return err
+			}
+			before, err := snapshot(ctx, tx)
+			if err != nil {
+				return fmt.Errorf("failed to snapshot schema: %w", err)
+			}
+			if _, err := ms.applyMigrations(ctx, tx, nil, Up, []*PlannedMigration{migration}); err != nil {
+				return err
+			}
+			if _, err := ms.applyMigrations(ctx, tx, nil, Down, []*PlannedMigration{down}); err != nil {
+				return err
+			}
+			after, err := snapshot(ctx, tx)
+			if err != nil {
+				return fmt.Errorf("failed to snapshot schema: %w", err)
+			}
+			if divergent := diffSnapshots(before, after); len(divergent) > 0 {
+				return newPlanError(migration.Migration, fmt.Sprintf("Down does not reverse Up, divergent objects: %s", strings.Join(divergent, ", ")))
+			}
+
+			again := newPlannedMigration(migration.Migration, Up)
+			if _, err := ms.applyMigrations(ctx, tx, nil, Up, []*PlannedMigration{again}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the sorted names of the objects missing from, added to or changed
+// in one of the snapshots.
+func diffSnapshots(before, after map[string]string) []string {
+	var divergent []string
+	for _, name := range sortedKeys(before) {
+		if definition, ok := after[name]; !ok || definition != before[name] {
+			divergent = append(divergent, name)
+		}
+	}
+	for _, name := range sortedKeys(after) {
+		if _, ok := before[name]; !ok {
+			divergent = append(divergent, name)
+		}
+	}
+	sort.Strings(divergent)
+	return divergent
+}
+
+// Execute exactly the given migrations, in the given order. See
+// MigrationSet.ExecExplicit.
+func ExecExplicit(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, ids []string) (int, error) {
+	return migSet.ExecExplicit(ctx, db, m, dir, ids)
+}
+
+// Applies exactly the migrations with the given Ids, in the given order,
+// recording them as usual. Each migration must exist in the source and, going
+// Up, not be applied yet or, going Down, be applied.
+//
+// This is a break-glass operation for incidents: it bypasses the ordering
+// checks of the planner, so migrations may end up applied out of order.
+//
+// Returns the number of applied migrations.
+func (ms MigrationSet) ExecExplicit(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, ids []string) (int, error) {
+	return ms.exec(ctx, db, dir, func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error) {
+		migrations, err := ms.findMigrations(m)
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]*Migration, len(migrations))
+		for _, migration := range migrations {
+			found[migration.Id] = migration
+		}
+
+		records, err := ms.GetMigrationRecords(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		if ms.RefuseDowngrade {
+			if err := checkDowngrade(migrations, records); err != nil {
+				return nil, err
+			}
+		}
+		applied := make(map[string]struct{}, len(records))
+		for _, record := range records {
+			applied[record.Id] = struct{}{}
+		}
+
+		planned := make(map[string]struct{}, len(ids))
+		result := make([]*PlannedMigration, 0, len(ids))
+		for _, id := range ids {
+			migration, ok := found[id]
+			if !ok {
+				return nil, newPlanError(&Migration{Id: id}, "migration not found in source")
+			}
+			if _, ok := planned[id]; ok {
+				return nil, newPlanError(migration, "migration requested more than once")
+			}
+			_, isApplied := applied[id]
+			if dir == Up && isApplied {
+				return nil, newPlanError(migration, "migration already applied")
+			}
+			if dir == Down && !isApplied {
+				return nil, newPlanError(migration, "migration not applied")
+			}
+
+			planned[id] = struct{}{}
+			result = append(result, newPlannedMigration(migration, dir))
+		}
+
+		return result, ms.checkRevertible(dir, result)
+	})
+}
+
+// Plans and applies migrations on a connection dedicated to the whole
+// execution, and returns the number of applied migrations.
+func (ms MigrationSet) exec(ctx context.Context, db Queryer, dir MigrationDirection, plan func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error)) (int, error) {
+	applied, err := ms.execPlan(ctx, db, dir, plan)
+	return len(applied), err
+}
+
+// Like exec, but returns the applied migrations.
+func (ms MigrationSet) execPlan(ctx context.Context, db Queryer, dir MigrationDirection, plan func(ms MigrationSet, conn Queryer) ([]*PlannedMigration, error)) ([]*PlannedMigration, error) {
+	if err := ms.checkDirection(dir); err != nil {
+		return nil, err
+	}
+
+	if ms.AppliedIdsCache != nil {
+		defer ms.AppliedIdsCache.Invalidate()
+	}
+
+	if ms.RunId == "" {
+		runId, err := newRunId()
+		if err != nil {
+			return nil, err
+		}
+		ms.RunId = runId
+	}
+
+	pool, _ := asConnPool(db)
+	var applied []*PlannedMigration
+	err := ms.withConn(ctx, db, func(conn Queryer) (err error) {
+		if err := ms.checkDatabase(ctx, conn); err != nil {
+			return err
+		}
+
+		if ms.UseAdvisoryLock {
+			unlock, lockErr := ms.lock(ctx, conn)
+			if lockErr != nil {
+				return lockErr
+			}
+			// A lock left held would block every later execution.
+			defer func() {
+				err = errors.Join(err, unlock())
+			}()
+		}
+
+		ms.checkClockSkew(ctx, conn)
+
+		if err := ms.checkIdentifierLength(ctx, conn); err != nil {
+			return err
+		}
+
+		// Create and verify the migration table once per execution, and
+		// not again while planning.
+		if err := ms.createMigrationTable(ctx, conn); err != nil {
+			return err
+		}
+		ms.tableChecked = true
+
+		if err := ms.checkDirty(ctx, conn); err != nil {
+			return err
+		}
+
+		migrations, err := plan(ms, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			err := migration.eachQuery(func(_ int, stmt string) error {
+				if _, err := ms.substituteEnv(stmt); err != nil {
+					return newPlanError(migration.Migration, err.Error())
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if dir == Down && ms.AtomicDown {
+			applied, err = ms.applyAtomically(ctx, conn, dir, migrations)
+		} else {
+			applied, err = ms.applyMigrations(ctx, conn, pool, dir, migrations)
+		}
+		if err != nil || len(applied) == 0 {
+			return err
+		}
+
+		for _, stmt := range ms.AfterAll {
+			if _, err := conn.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("failed to exec after-all statement %q: %w", stmt, err)
+			}
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// How often the advisory lock is tried while another execution holds it.
+const lockPollInterval = 100 * time.Millisecond
+
+// Acquires the advisory lock of the migration table on the connection,
+// polling until it is free or the context is done, and returns the function
+// releasing it. The lock belongs to the session, so the connection must not be
+// a pool, which could release it on another connection.
+func (ms MigrationSet) lock(ctx context.Context, conn Queryer) (func() error, error) {
+	if _, ok := asConnPool(conn); ok {
+		return nil, errors.New("migration lock must be taken on a dedicated connection, not a pool")
+	}
+
+	key := ms.lockKey()
+	start := time.Now()
+	for {
+		var locked bool
+		if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+			if ctx.Err() != nil {
+				return nil, &LockTimeoutError{Waited: time.Since(start), Err: ctx.Err()}
+			}
+			return nil, fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		if locked {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, &LockTimeoutError{Waited: time.Since(start), Err: ctx.Err()}
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	return func() error {
+		// Release the lock even if the context was canceled meanwhile.
+		var unlocked bool
+		if err := conn.QueryRow(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", key).Scan(&unlocked); err != nil {
+			return fmt.Errorf("failed to release migration lock: %w", err)
+		}
+		if !unlocked {
+			return fmt.Errorf("failed to release migration lock %d: it is not held by the connection", key)
+		}
+		return nil
+	}, nil
+}
+
+// Logs a warning if the clocks of the database and of the process differ by
+// more than MaxClockSkew.
+func (ms MigrationSet) checkClockSkew(ctx context.Context, conn Queryer) {
+	if ms.MaxClockSkew <= 0 || ms.Logger == nil {
+		return
+	}
+
+	before := time.Now()
+	var dbNow time.Time
+	if err := conn.QueryRow(ctx, "SELECT clock_timestamp()").Scan(&dbNow); err != nil {
+		ms.logf("warning: failed to read database clock: %s", err)
+		return
+	}
+	after := time.Now()
+
+	// Compare with the middle of the round trip.
+	local := before.Add(after.Sub(before) / 2)
+	skew := dbNow.Sub(local)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > ms.MaxClockSkew {
+		ms.logf("warning: database clock differs from local clock by %s (database %s, local %s)", skew, dbNow.UTC().Format(time.RFC3339Nano), local.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// PostgreSQL truncates longer identifiers, unless it was built with another
+// NAMEDATALEN.
+const defaultMaxIdentifierLength = 63
+
+// Fails if the connection is not to the ExpectDatabase, or to a server older
+// than ExpectServerVersion.
+func (ms MigrationSet) checkDatabase(ctx context.Context, conn Queryer) error {
+	if ms.ExpectDatabase != "" {
+		var database string
+		if err := conn.QueryRow(ctx, "SELECT current_database()").Scan(&database); err != nil {
+			return fmt.Errorf("failed to look up database name: %w", err)
+		}
+		if database != ms.ExpectDatabase {
+			return fmt.Errorf("connected to database %q, but ExpectDatabase is %q", database, ms.ExpectDatabase)
+		}
+	}
+
+	if ms.ExpectServerVersion != "" {
+		required, err := parseServerVersion(ms.ExpectServerVersion)
+		if err != nil {
+			return fmt.Errorf("invalid ExpectServerVersion: %w", err)
+		}
+		var version string
+		var current int
+		if err := conn.QueryRow(ctx, "SELECT current_setting('server_version'), current_setting('server_version_num')::int").Scan(&version, &current); err != nil {
+			return fmt.Errorf("failed to look up server version: %w", err)
+		}
+		if current < required {
+			return fmt.Errorf("server version %s is older than ExpectServerVersion %s", version, ms.ExpectServerVersion)
+		}
+	}
+
+	return nil
+}
+
+// Fails if the table or schema name is longer than the identifiers of the
+// server, which would silently truncate it and use another table than the
+// configured one.
+func (ms MigrationSet) checkIdentifierLength(ctx context.Context, conn Queryer) error {
+	names := []string{ms.SchemaName, ms.getTableName()}
+	if len(names[0]) <= defaultMaxIdentifierLength && len(names[1]) <= defaultMaxIdentifierLength {
+		// No server allows shorter identifiers.
+		return nil
+	}
+
+	max := defaultMaxIdentifierLength
+	if err := conn.QueryRow(ctx, "SELECT current_setting('max_identifier_length')::int").Scan(&max); err != nil {
+		max = defaultMaxIdentifierLength
+	}
+	for _, name := range names {
+		if len(name) > max {
+			return fmt.Errorf("migration table identifier %q is %d bytes long, more than the %d bytes allowed by the database", name, len(name), max)
+		}
+	}
+	return nil
+}
+
+// Returns the advisory lock key of the migration table.
+func (ms MigrationSet) lockKey() int64 {
+	if ms.LockKey != nil {
+		return ms.LockKey(ms.SchemaName, ms.getTableName())
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(ms.quotedTableName()))
+	return int64(h.Sum64())
+}
+
+// Runs fn with a single connection held for its whole duration. Connection
+// pools are asked for a dedicated connection, which is released afterwards.
+func (ms MigrationSet) withConn(ctx context.Context, db Queryer, fn func(conn Queryer) error) error {
+	conn := db
+	if pool, ok := asConnPool(db); ok {
+		c, release, err := pool.AcquireConn(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to acquire db connection: %w", err)
+		}
+		defer release()
+		conn = c
+	}
+
+	if ms.ApplicationName != "" {
+		var previous string
+		if err := conn.QueryRow(ctx, "SELECT current_setting('application_name')").Scan(&previous); err != nil {
+			return fmt.Errorf("failed to look up application_name: %w", err)
+		}
+		if _, err := conn.Exec(ctx, "SELECT set_config('application_name', $1, false)", ms.ApplicationName); err != nil {
+			return fmt.Errorf("failed to set application_name: %w", err)
+		}
+		defer conn.Exec(context.WithoutCancel(ctx), "SELECT set_config('application_name', $1, false)", previous)
+	}
+
+	if ms.searchPath != "" {
+		var previous string
+		if err := conn.QueryRow(ctx, "SELECT current_setting('search_path')").Scan(&previous); err != nil {
+			return fmt.Errorf("failed to look up search_path: %w", err)
+		}
+		searchPath := ms.searchPath
+		if strings.TrimSpace(previous) != "" {
+			searchPath += ", " + previous
+		}
+		if _, err := conn.Exec(ctx, "SELECT set_config('search_path', $1, false)", searchPath); err != nil {
+			return fmt.Errorf("failed to set search_path: %w", err)
+		}
+		defer conn.Exec(context.WithoutCancel(ctx), "SELECT set_config('search_path', $1, false)", previous)
+	}
+
+	if ms.OnAcquireConn != nil {
+		if err := ms.OnAcquireConn(ctx, conn); err != nil {
+			return fmt.Errorf("failed to prepare db connection: %w", err)
+		}
+	}
+
+	return fn(conn)
+}
+
+// Applies the planned migrations and returns the applied ones.
+//
+// Contiguous migrations of the same parallel group are applied concurrently,
+// each on its own connection of the pool. Without a pool, or if the pool can't
+// hand out a connection besides the given one, they are applied one after the
+// other on the given connection.
+func (ms MigrationSet) applyMigrations(ctx context.Context, db Queryer, pool ConnPool, dir MigrationDirection, migrations []*PlannedMigration) ([]*PlannedMigration, error) {
+	var applied []*PlannedMigration
+
+	for i := 0; i < len(migrations); {
+		if err := ms.checkTimeBudget(ctx, migrations[i].Migration); err != nil {
+			return applied, err
+		}
+
+		group := leadingParallelGroup(migrations[i:])
+		if pool == nil || !hasSpareConns(pool) {
+			group = migrations[i : i+1]
+		}
+
+		for j, migration := range group {
+			if ms.OnProgress != nil {
+				ms.OnProgress(i+j+1, len(migrations), migration.Migration)
+			}
+		}
+
+		if len(group) > 1 {
+			groupApplied, err := ms.applyParallel(ctx, pool, dir, group)
+			applied = append(applied, groupApplied...)
+			if err != nil {
+				return applied, err
+			}
+		} else if err := ms.applyAndReport(ctx, db, dir, group[0]); err != nil {
+			return applied, err
+		} else {
+			applied = append(applied, group[0])
+		}
+
+		i += len(group)
+	}
+
+	return applied, nil
+}
+
+// Applies the planned migrations in a single transaction, which is committed
+// only if all of them succeed. Each migration runs in a savepoint of it.
+func (ms MigrationSet) applyAtomically(ctx context.Context, conn Queryer, dir MigrationDirection, migrations []*PlannedMigration) ([]*PlannedMigration, error) {
+	for _, migration := range migrations {
+		if migration.DisableTransaction {
+			return nil, newPlanError(migration.Migration, "notransaction migrations cannot be applied atomically")
+		}
+	}
+
+	// Migrations are only reported once their savepoint can no longer be
+	// rolled back with the transaction, except for the failed one.
+	var results []MigrationResult
+	onResult := ms.onResult
+	if onResult != nil {
+		ms.onResult = func(result MigrationResult) {
+			results = append(results, result)
+		}
+	}
+	report := func(failed bool) {
+		if onResult == nil {
+			return
+		}
+		for _, result := range results {
+			if !failed || result.Err != nil {
+				onResult(result)
+			}
+		}
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init db transaction: %w", err)
+	}
+	if _, err := ms.applyMigrations(ctx, tx, nil, dir, migrations); err != nil {
+		tx.Rollback(ctx)
+		report(true)
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit db transaction: %w", err)
+	}
+	report(false)
+	return migrations, nil
+}
+
+// Returns the leading migrations sharing the same parallel group, or only the
+// first migration if it has none.
+func leadingParallelGroup(migrations []*PlannedMigration) []*PlannedMigration {
+	group := migrations[0].ParallelGroup
+	n := 1
+	for group != "" && n < len(migrations) && migrations[n].ParallelGroup == group {
+		n++
+	}
+	return migrations[:n]
+}
+
+// Reports whether the pool can hand out connections besides the one held by
+// the execution, so that waiting for one doesn't block forever. Pools which
+// don't report their size are assumed to.
+func hasSpareConns(pool ConnPool) bool {
+	if p, ok := pool.(interface{ Stat() *pgxpool.Stat }); ok {
+		return p.Stat().MaxConns() > 1
+	}
+	return true
+}
+
+// Applies the migrations concurrently, each on a connection acquired from the
+// pool. All migrations are awaited, and their errors aggregated.
+func (ms MigrationSet) applyParallel(ctx context.Context, pool ConnPool, dir MigrationDirection, migrations []*PlannedMigration) ([]*PlannedMigration, error) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(migrations))
+	for i, migration := range migrations {
+		wg.Add(1)
+		go func(i int, migration *PlannedMigration) {
+			defer wg.Done()
+			errs[i] = ms.withConn(ctx, pool, func(conn Queryer) error {
+				return ms.applyAndReport(ctx, conn, dir, migration)
+			})
+		}(i, migration)
+	}
+	wg.Wait()
+
+	var applied []*PlannedMigration
+	for i, err := range errs {
+		if err == nil {
+			applied = append(applied, migrations[i])
+		}
+	}
+	return applied, errors.Join(errs...)
+}
+
+// Applies a single planned migration and reports its result, if requested.
+func (ms MigrationSet) applyAndReport(ctx context.Context, db Queryer, dir MigrationDirection, migration *PlannedMigration) error {
+	start := time.Now()
+	err := ms.applyMigrationWithRetries(ctx, db, dir, migration)
+	if ms.onResult != nil {
+		ms.onResult(MigrationResult{
+			Migration: migration.Migration,
+			Duration:  time.Since(start),
+			Err:       err,
+			Warnings:  migration.warnings,
+		})
+	}
+	return err
+}
+
+// Applies a single planned migration, retrying it on retryable errors.
+func (ms MigrationSet) applyMigrationWithRetries(ctx context.Context, db Queryer, dir MigrationDirection, migration *PlannedMigration) error {
+	err := ms.applyMigration(ctx, db, dir, migration)
+	for attempt := 0; err != nil && !migration.DisableTransaction && attempt < ms.MaxRetries && ms.isRetryable(err); attempt++ {
+		err = ms.applyMigration(ctx, db, dir, migration)
+	}
+	if err != nil && isConnectionLost(db, err) {
+		return newConnectionLostError(migration, err)
+	}
+	return err
+}
+
+func (ms MigrationSet) isRetryable(err error) bool {
+	if ms.IsRetryable != nil {
+		return ms.IsRetryable(err)
+	}
+	return pgconn.SafeToRetry(err)
+}
+
+// Applies a single planned migration and its bookkeeping within a transaction.
+func (ms MigrationSet) applyMigration(ctx context.Context, db Queryer, dir MigrationDirection, migration *PlannedMigration) error {
+	start := time.Now()
+	eachQuery := migration.eachQuery
+	unmet, err := unmetRequirement(ctx, db, migration.Migration)
+	if err != nil {
+		return err
+	}
+	if unmet != nil {
+		if !ms.SkipUnmetRequirements {
+			return newPlanError(migration.Migration, fmt.Sprintf("requirement %q is not met by the database", unmet))
+		}
+		eachQuery = func(func(int, string) error) error { return nil }
+	}
+
+	if migration.DisableTransaction {
+		return ms.applyMigrationWithoutTransaction(ctx, db, dir, migration, eachQuery, start)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to init db transaction: %w", err)
+	}
+	if err := ms.switchRole(ctx, tx, ms.Role, true); err != nil {
+		tx.Rollback(ctx)
+		return newTxError(migration, err)
+	}
+	if err := setStatementTimeout(ctx, tx, migration.Timeout, true); err != nil {
+		tx.Rollback(ctx)
+		return newTxError(migration, err)
+	}
+
+	migration.warnings = nil
+	err = eachQuery(func(i int, stmt string) error {
+		sql, err := ms.substituteEnv(stmt)
+		if err != nil {
+			return newPlanError(migration.Migration, err.Error())
+		}
+		if migration.ContinueOnError {
+			if err = ms.execInSavepoint(ctx, tx, migration.Migration, i, sql); err != nil {
+				warning := &StatementError{Migration: migration.Migration, Index: i, Statement: stmt, Err: err}
+				migration.warnings = append(migration.warnings, warning)
+				ms.logf("warning: skipped failed statement: %s", warning)
+			}
+			return nil
+		}
+		if err = ms.explain(ctx, tx, migration.Migration, i, sql); err != nil {
+			return &StatementError{Migration: migration.Migration, Index: i, Statement: stmt, Err: err}
+		}
+		// Report the statement before substitution to keep secrets out of
+		// errors.
+		if _, err = tx.Exec(ctx, sql, migrationExecMode); err != nil {
+			return &StatementError{Migration: migration.Migration, Index: i, Statement: stmt, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	if ms.recordsRole() != ms.Role {
+		if err := ms.switchRole(ctx, tx, ms.recordsRole(), true); err != nil {
+			tx.Rollback(ctx)
+			return newTxError(migration, err)
+		}
+	}
+	switch dir {
+	case Up:
+		if err = ms.insertRecord(ctx, tx, migration.Migration, false, time.Since(start)); err != nil {
+			tx.Rollback(ctx)
+			return newTxError(migration, err)
+		}
+		if err = ms.notify(ctx, tx, migration.Migration); err != nil {
+			tx.Rollback(ctx)
+			return newTxError(migration, err)
+		}
+	case Down:
+		if err = ms.deleteRecord(ctx, tx, migration.Migration); err != nil {
+			tx.Rollback(ctx)
+			return newTxError(migration, err)
+		}
+	default:
+		panic("Invalid direction")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return newTxError(migration, err)
+	}
+
+	return nil
+}
+
+// Returns the role the records are written under.
+func (ms MigrationSet) recordsRole() string {
+	if ms.RecordsRole != "" {
+		return ms.RecordsRole
+	}
+	return ms.Role
+}
+
+// Switches to the role for the rest of the transaction if local is set, or
+// else of the session. Nothing is done if the role is empty, so that the role
+// of the session, such as one set by OnAcquireConn, is kept.
+func (ms MigrationSet) switchRole(ctx context.Context, db Queryer, role string, local bool) error {
+	if role == "" {
+		return nil
+	}
+
+	scope := "SESSION"
+	if local {
+		scope = "LOCAL"
+	}
+	name := pgx.Identifier{role}.Sanitize()
+	if _, err := db.Exec(ctx, fmt.Sprintf("SET %s ROLE %s", scope, name)); err != nil {
+		return fmt.Errorf("failed to set role %s: %w", name, err)
+	}
+	return nil
+}
+
+// Bounds the following statements to the timeout, for the rest of the
+// transaction if local is set, or else of the session. Nothing is done unless
+// the timeout is positive.
+func setStatementTimeout(ctx context.Context, db Queryer, timeout time.Duration, local bool) error {
+	if timeout <= 0 {
+		return nil
+	}
+
+	scope := "SESSION"
+	if local {
+		scope = "LOCAL"
+	}
+	if _, err := db.Exec(ctx, fmt.Sprintf("SET %s statement_timeout = %d", scope, timeout.Milliseconds())); err != nil {
+		return fmt.Errorf("failed to set statement timeout: %w", err)
+	}
+	return nil
+}
+
+// Explains and executes the statement of the migration in a savepoint of the
+// transaction, which is rolled back if either fails so that the transaction
+// can go on.
+func (ms MigrationSet) execInSavepoint(ctx context.Context, tx pgx.Tx, migration *Migration, index int, sql string) error {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	err = ms.explain(ctx, sp, migration, index, sql)
+	if err == nil {
+		_, err = sp.Exec(ctx, sql, migrationExecMode)
+	}
+	if err != nil {
+		if rbErr := sp.Rollback(ctx); rbErr != nil {
+			return errors.Join(err, rbErr)
+		}
+		return err
+	}
+	return sp.Commit(ctx)
+}
+
+// Notifies the NotifyChannel, if any, that the migration was applied.
+func (ms MigrationSet) notify(ctx context.Context, db Queryer, migration *Migration) error {
+	if ms.NotifyChannel == "" {
+		return nil
+	}
+	if _, err := db.Exec(ctx, "SELECT pg_notify($1, $2)", ms.NotifyChannel, migration.Id); err != nil {
+		return fmt.Errorf("failed to notify %s: %w", ms.NotifyChannel, err)
+	}
+	return nil
+}
+
+// Applies a single planned migration and its bookkeeping outside of any
+// transaction, for statements such as CREATE INDEX CONCURRENTLY.
+func (ms MigrationSet) applyMigrationWithoutTransaction(ctx context.Context, db Queryer, dir MigrationDirection, migration *PlannedMigration, eachQuery func(fn func(i int, query string) error) error, start time.Time) error {
+	// The roles are set on the session, which gets its own role back
+	// afterwards rather than the login role.
+	role, recordsRole := ms.Role, ms.recordsRole()
+	if role != "" || recordsRole != "" {
+		var previous string
+		if err := db.QueryRow(ctx, "SELECT current_user").Scan(&previous); err != nil {
+			return newTxError(migration, fmt.Errorf("failed to look up current role: %w", err))
+		}
+		defer db.Exec(context.WithoutCancel(ctx), fmt.Sprintf("SET SESSION ROLE %s", pgx.Identifier{previous}.Sanitize()))
+		if role == "" {
+			role = previous
+		}
+		if recordsRole == "" {
+			recordsRole = previous
+		}
+	}
+
+	// Mark the record dirty while the statements run, so that an
+	// interrupted migration is not blindly run again.
+	err := ms.switchRole(ctx, db, recordsRole, false)
+	if err != nil {
+		return newTxError(migration, err)
+	}
+	switch dir {
+	case Up:
+		err = ms.insertRecord(ctx, db, migration.Migration, true, 0)
+	case Down:
+		err = ms.setDirty(ctx, db, migration.Migration, true)
+	default:
+		panic("Invalid direction")
+	}
+	if err != nil {
+		return newTxError(migration, err)
+	}
+
+	if err := ms.switchRole(ctx, db, role, false); err != nil {
+		return newTxError(migration, err)
+	}
+	if migration.Timeout > 0 {
+		defer db.Exec(context.WithoutCancel(ctx), "RESET statement_timeout")
+	}
+	if err := setStatementTimeout(ctx, db, migration.Timeout, false); err != nil {
+		return newTxError(migration, err)
+	}
+	err = eachQuery(func(i int, stmt string) error {
+		sql, err := ms.substituteEnv(stmt)
+		if err != nil {
+			return newPlanError(migration.Migration, err.Error())
+		}
+		if err = ms.explain(ctx, db, migration.Migration, i, sql); err != nil {
+			return &StatementError{Migration: migration.Migration, Index: i, Statement: stmt, Err: err}
+		}
+		if _, err = db.Exec(ctx, sql, migrationExecMode); err != nil {
+			return &StatementError{Migration: migration.Migration, Index: i, Statement: stmt, Err: err}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ms.switchRole(ctx, db, recordsRole, false); err != nil {
+		return newTxError(migration, err)
+	}
+	switch dir {
+	case Up:
+		err = ms.completeRecord(ctx, db, migration.Migration, time.Since(start))
+		if err == nil {
+			err = ms.notify(ctx, db, migration.Migration)
+		}
+	case Down:
+		err = ms.deleteRecord(ctx, db, migration.Migration)
+	}
+	if err != nil {
+		return newTxError(migration, err)
+	}
+
+	return nil
+}
+
+// Logs the estimated cost of the statement of the migration if it is DML and
+// ExplainBeforeApply is set.
+func (ms MigrationSet) explain(ctx context.Context, db Queryer, migration *Migration, index int, sql string) error {
+	if !ms.ExplainBeforeApply || ms.Logger == nil || !isDML(sql) {
+		return nil
+	}
+
+	rows, err := db.Query(ctx, "EXPLAIN "+sql, migrationExecMode)
+	if err != nil {
+		return fmt.Errorf("failed to explain statement: %w", err)
+	}
+	plan, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to explain statement: %w", err)
+	}
+	if len(plan) > 0 {
+		ms.logf("statement %d of migration %s is estimated as: %s", index, migration.Id, strings.TrimSpace(plan[0]))
+	}
+	return nil
+}
+
+// Reports whether the statement is an INSERT, UPDATE or DELETE.
+func isDML(sql string) bool {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "INSERT", "UPDATE", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Reports whether the statement begins or ends a transaction, such as BEGIN or
+// COMMIT. Savepoints are not considered.
+func isTransactionControl(sql string) bool {
+	var fields []string
+	for _, line := range strings.Split(sql, "\n") {
+		if trimmed := strings.TrimSpace(line); !strings.HasPrefix(trimmed, "--") {
+			fields = append(fields, strings.Fields(strings.ToUpper(line))...)
+		}
+		if len(fields) >= 2 {
+			break
+		}
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.TrimSuffix(fields[0], ";") {
+	case "BEGIN", "START", "COMMIT", "END", "ABORT":
+		return true
+	case "ROLLBACK":
+		// ROLLBACK TO SAVEPOINT stays in the transaction.
+		return len(fields) == 1 || fields[1] != "TO"
+	}
+	return false
+}
+
+// Migration statements are run once, and may change the objects referenced by
+// the cached plans of prepared statements, so they are never prepared.
+const migrationExecMode = pgx.QueryExecModeSimpleProtocol
+
+var envTokenRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Replaces the ${NAME} tokens of the statement with the value of the
+// variables, if EnableEnvSubstitution is set.
+func (ms MigrationSet) substituteEnv(stmt string) (string, error) {
+	if !ms.EnableEnvSubstitution {
+		return stmt, nil
+	}
+	lookupEnv := ms.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+
+	var err error
+	result := envTokenRegex.ReplaceAllStringFunc(stmt, func(token string) string {
+		name := envTokenRegex.FindStringSubmatch(token)[1]
+		value, ok := lookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return result, err
+}
+
+// Returns the context for a query on the migration table, see RecordsTimeout.
+func (ms MigrationSet) recordsContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ms.RecordsTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, ms.RecordsTimeout)
+}
+
+// Records the migration as reverted, along with the migrations it replaces
+// whose records stand for its own.
+func (ms MigrationSet) deleteRecord(ctx context.Context, db Queryer, migration *Migration) error {
+	ctx, cancel := ms.recordsContext(ctx)
+	defer cancel()
+
+	ids := append([]string{migration.Id}, migration.Replaces...)
+	if ms.KeepRevertedRecords {
+		_, err := db.Exec(ctx, fmt.Sprintf("UPDATE %s SET reverted_at = now(), dirty = false WHERE id = ANY($1) AND reverted_at IS NULL", ms.quotedTableName()), ids)
+		return err
+	}
+	_, err := db.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ANY($1)", ms.quotedTableName()), ids)
+	return err
+}
+
+// Sets or clears the dirty flag of the record of the migration.
+func (ms MigrationSet) setDirty(ctx context.Context, db Queryer, migration *Migration, dirty bool) error {
+	ctx, cancel := ms.recordsContext(ctx)
+	defer cancel()
+
+	_, err := db.Exec(ctx, fmt.Sprintf("UPDATE %s SET dirty = $2 WHERE id = $1 AND reverted_at IS NULL", ms.quotedTableName()), migration.Id, dirty)
+	return err
+}
+
+// Clears the dirty flag of the record of the migration once applied, and
+// records its duration.
+func (ms MigrationSet) completeRecord(ctx context.Context, db Queryer, migration *Migration, duration time.Duration) error {
+	if !ms.RecordDuration {
+		return ms.setDirty(ctx, db, migration, false)
+	}
+
+	ctx, cancel := ms.recordsContext(ctx)
+	defer cancel()
+
+	_, err := db.Exec(ctx, fmt.Sprintf("UPDATE %s SET dirty = false, duration_ms = $2 WHERE id = $1 AND reverted_at IS NULL", ms.quotedTableName()), migration.Id, duration.Milliseconds())
+	return err
+}
+
+// Fails with a *DirtyError if migrations were interrupted while running
+// without a transaction.
+func (ms MigrationSet) checkDirty(ctx context.Context, db Queryer) error {
+	ctx, cancel := ms.recordsContext(ctx)
+	defer cancel()
+
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT id FROM %s WHERE dirty AND reverted_at IS NULL ORDER BY apply_seq ASC", ms.quotedTableName()))
+	if err != nil {
+		return fmt.Errorf("failed to look up interrupted migrations: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to look up interrupted migrations: %w", err)
+	}
+	if len(ids) > 0 {
+		return &DirtyError{Ids: ids}
+	}
+	return nil
+}
+
+// Fails with a *DirtyError if any of the records is dirty.
+func checkDirtyRecords(records []*MigrationRecord) error {
+	var ids []string
+	for _, record := range records {
+		if record.Dirty {
+			ids = append(ids, record.Id)
+		}
+	}
+	if len(ids) > 0 {
+		return &DirtyError{Ids: ids}
+	}
+	return nil
+}
+
+// Records the migration as applied, or as being applied if dirty is set.
+func (ms MigrationSet) insertRecord(ctx context.Context, db Queryer, migration *Migration, dirty bool, duration time.Duration) error {
+	ctx, cancel := ms.recordsContext(ctx)
+	defer cancel()
+
+	columns := []string{"id", "applied_at", "checksum", "statements", "dirty"}
+	values := []string{"$1", "now()", "$2", "$3", "$4"}
+	args := []any{migration.Id, migration.Checksum(), migration.statementCount(Up), dirty}
+	if ms.RecordProvenance {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to look up hostname: %w", err)
+		}
+		columns = append(columns, "applied_by", "hostname")
+		args = append(args, ms.Actor, hostname)
+		values = append(values, fmt.Sprintf("$%d", len(args)-1), fmt.Sprintf("$%d", len(args)))
+	}
+	if ms.RecordDuration {
+		columns = append(columns, "duration_ms")
+		args = append(args, duration.Milliseconds())
+		values = append(values, fmt.Sprintf("$%d", len(args)))
+	}
+	if ms.RecordRunId {
+		columns = append(columns, "run_id")
+		args = append(args, ms.RunId)
+		values = append(values, fmt.Sprintf("$%d", len(args)))
+	}
+	if ms.RecordInsertDecorator != nil {
+		extra := ms.RecordInsertDecorator(migration)
+		for _, name := range sortedKeys(extra) {
+			columns = append(columns, pgx.Identifier{name}.Sanitize())
+			args = append(args, extra[name])
+			values = append(values, fmt.Sprintf("$%d", len(args)))
+		}
+	}
+
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", ms.quotedTableName(), strings.Join(columns, ", "), strings.Join(values, ", "))
+	var replaced []string
+	if ms.KeepRevertedRecords {
+		replaced = append(replaced, fmt.Sprintf("%s.reverted_at IS NOT NULL", ms.quotedTableName()))
+	}
+	if ms.AppliedPredicate != "" {
+		replaced = append(replaced, fmt.Sprintf("(%s) IS NOT TRUE", ms.AppliedPredicate))
+	}
+	if len(replaced) > 0 {
+		// Replace the record of a reverted migration applied again.
+		updates := []string{"apply_seq = DEFAULT", "reverted_at = NULL"}
+		for _, column := range columns[1:] {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+		}
+		if ms.AppliedPredicate != "" {
+			inserted := make(map[string]struct{}, len(columns))
+			for _, column := range columns {
+				inserted[column] = struct{}{}
+			}
+			for _, name := range sortedKeys(ms.RecordColumns) {
+				if _, ok := inserted[pgx.Identifier{name}.Sanitize()]; !ok {
+					updates = append(updates, fmt.Sprintf("%s = DEFAULT", pgx.Identifier{name}.Sanitize()))
+				}
+			}
+		}
+		sql += fmt.Sprintf(" ON CONFLICT (id) DO UPDATE SET %s WHERE %s", strings.Join(updates, ", "), strings.Join(replaced, " OR "))
+	}
+
+	if ms.AppliedPredicate != "" {
+		var applied bool
+		err := db.QueryRow(ctx, sql+fmt.Sprintf(" RETURNING (%s) IS TRUE", ms.AppliedPredicate), args...).Scan(&applied)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("migration %s is already recorded", migration.Id)
+		}
+		if err == nil && !applied {
+			err = fmt.Errorf("record of migration %s doesn't satisfy AppliedPredicate once applied", migration.Id)
+		}
+		return err
+	}
+
+	tag, err := db.Exec(ctx, sql, args...)
+	if err == nil && tag.RowsAffected() != 1 {
+		err = fmt.Errorf("migration %s is already recorded", migration.Id)
+	}
+	return err
+}
+
+// Returns the first requirement of the migration not met by the database, or
+// nil if they are all met.
+func unmetRequirement(ctx context.Context, db Queryer, migration *Migration) (*Requirement, error) {
+	for i, r := range migration.Requires {
+		var met bool
+		switch r.Kind {
+		case RequirementExtension:
+			if err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = $1)", r.Value).Scan(&met); err != nil {
+				return nil, fmt.Errorf("failed to probe requirement %q of %s: %w", r, migration.Id, err)
+			}
+		case RequirementVersion:
+			required, err := parseServerVersion(r.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid requirement %q of %s: %w", r, migration.Id, err)
+			}
+			var current int
+			if err := db.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&current); err != nil {
+				return nil, fmt.Errorf("failed to probe requirement %q of %s: %w", r, migration.Id, err)
+			}
+			met = current >= required
+		default:
+			return nil, fmt.Errorf("unknown requirement %q of %s", r, migration.Id)
+		}
+
+		if !met {
+			return &migration.Requires[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Converts a version such as "14", "14.2", "9.6" or "9.6.24" to the
+// server_version_num format. Since PostgreSQL 10, versions only have a major
+// and a minor number, and server_version_num is major*10000 + minor. Before,
+// the major version had two numbers, and it is major*10000 + minor*100 + patch.
+func parseServerVersion(version string) (int, error) {
+	parts := strings.Split(version, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return 0, fmt.Errorf("could not parse version %q", version)
+		}
+		numbers[i] = number
+	}
+
+	if numbers[0] >= 10 {
+		if len(numbers) > 2 {
+			return 0, fmt.Errorf("could not parse version %q", version)
+		}
+		numbers = append(numbers, 0)
+		return numbers[0]*10000 + numbers[1], nil
+	}
+	if len(numbers) > 3 {
+		return 0, fmt.Errorf("could not parse version %q", version)
+	}
+	numbers = append(numbers, 0, 0)
+	return numbers[0]*10000 + numbers[1]*100 + numbers[2], nil
+}
+
+// Plan a migration.
+func PlanMigration(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, max int) ([]*PlannedMigration, error) {
+	return migSet.PlanMigration(ctx, db, m, dir, max)
+}
+
+// Plan a migration to version.
+func PlanMigrationToVersion(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, version int64) ([]*PlannedMigration, error) {
+	return migSet.PlanMigrationToVersion(ctx, db, m, dir, version)
+}
+
+// Plan a migration restricted to an inclusive range of Ids.
+func PlanMigrationRange(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, fromId, toId string) ([]*PlannedMigration, error) {
+	return migSet.PlanMigrationRange(ctx, db, m, dir, fromId, toId)
+}
+
+// Plan a migration.
+func (ms MigrationSet) PlanMigration(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, max int) ([]*PlannedMigration, error) {
+	migrations, err := ms.planMigrationCommon(ctx, db, m, dir, max, -1)
+	if err != nil {
+		return nil, err
+	}
+	return migrations, ms.checkRevertible(dir, migrations)
+}
+
+// Plan a migration to version.
+func (ms MigrationSet) PlanMigrationToVersion(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, version int64) ([]*PlannedMigration, error) {
+	migrations, err := ms.planMigrationCommon(ctx, db, m, dir, 0, version)
+	if err != nil {
+		return nil, err
+	}
+	return migrations, ms.checkRevertible(dir, migrations)
+}
+
+// Plan a migration restricted to an inclusive range of Ids.
+//
+// Ids are compared using Migration.Less. Planning fails when going Up with
+// unapplied migrations below fromId, or when going Down with applied
+// migrations above toId, as those would otherwise be skipped.
+func (ms MigrationSet) PlanMigrationRange(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, fromId, toId string) ([]*PlannedMigration, error) {
+	from := &Migration{Id: fromId}
+	to := &Migration{Id: toId}
+	if to.Less(from) {
+		return nil, fmt.Errorf("invalid migration range: %s is lower than %s", toId, fromId)
+	}
+
+	ms.DisableFillHoles = false
+	migrations, err := ms.planMigrationCommon(ctx, db, m, dir, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*PlannedMigration, 0, len(migrations))
+	for _, migration := range migrations {
+		switch {
+		case migration.Less(from):
+			if dir == Up {
+				return nil, newPlanError(migration.Migration, fmt.Sprintf("unapplied migration below range start %s", fromId))
+			}
+		case to.Less(migration.Migration):
+			if dir == Down {
+				return nil, newPlanError(migration.Migration, fmt.Sprintf("applied migration above range end %s", toId))
+			}
+		default:
+			result = append(result, migration)
+		}
+	}
+
+	return result, ms.checkRevertible(dir, result)
+}
+
+// A common method to plan a migration.
+func (ms MigrationSet) planMigrationCommon(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, max int, version int64) ([]*PlannedMigration, error) {
+	if err := ms.checkDirection(dir); err != nil {
+		return nil, err
+	}
+	if err := ms.createMigrationTable(ctx, db); err != nil {
+		return nil, err
+	}
+
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 {
+		ms.logf("warning: migration source has no migrations")
+	}
+
+	migrationRecords, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDirtyRecords(migrationRecords); err != nil {
+		return nil, err
+	}
+
+	return ms.planMigrations(migrations, migrationRecords, dir, max, version)
+}
+
+// Fails with ErrDownDisabled if the direction is not allowed.
+func (ms MigrationSet) checkDirection(dir MigrationDirection) error {
+	if dir == Down && ms.AllowedDirections == UpOnly {
+		return ErrDownDisabled
+	}
+	return nil
+}
+
+// Plans the sorted migrations of the source against the applied ones, without
+// touching the database. It runs in linear time, so that sources with
+// thousands of migrations are planned quickly.
+func (ms MigrationSet) planMigrations(migrations []*Migration, migrationRecords []*MigrationRecord, dir MigrationDirection, max int, version int64) ([]*PlannedMigration, error) {
+	migrationRecords, err := replaceRecords(migrations, migrationRecords)
+	if err != nil {
+		return nil, err
+	}
+
+	if ms.RefuseDowngrade {
+		if err := checkDowngrade(migrations, migrationRecords); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure all migrations in the database are among the found migrations which
+	// are to be applied.
+	if !ms.IgnoreUnknown {
+		migrationsSearch := make(map[string]struct{}, len(migrations))
+		for _, migration := range migrations {
+			migrationsSearch[migration.Id] = struct{}{}
+		}
+		for _, migrationRecord := range migrationRecords {
+			if _, ok := migrationsSearch[migrationRecord.Id]; ok {
+				continue
+			}
+			if ms.OnUnknownMigration != nil {
+				ignore, err := ms.OnUnknownMigration(*migrationRecord)
+				if err != nil {
+					return nil, err
+				}
+				if ignore {
+					continue
+				}
+			}
+			return nil, newPlanError(&Migration{Id: migrationRecord.Id}, "unknown migration in database")
+		}
+	}
+
+	// Get last migration that was run
+	record := &Migration{}
+	existingMigrations := make([]*Migration, 0, len(migrationRecords))
+	for _, migrationRecord := range migrationRecords {
+		existing := &Migration{Id: migrationRecord.Id}
+		if record.Id == "" || record.Less(existing) {
+			record = existing
+		}
+		existingMigrations = append(existingMigrations, existing)
+	}
+
+	result := make([]*PlannedMigration, 0)
+
+	// Add missing migrations up to the last run migration.
+	// This can happen for example when merges happened.
+	if len(existingMigrations) > 0 {
+		result = append(result, ToCatchup(migrations, existingMigrations, record)...)
+	}
+	if ms.DisableFillHoles && len(result) > 0 {
+		return nil, newPlanError(result[0].Migration, fmt.Sprintf("unapplied migration below the last applied one %s and DisableFillHoles is enabled", record.Id))
+	}
+
+	// Migrations can only be reverted once applied, or caught up above.
+	applied := make(map[string]struct{}, len(existingMigrations)+len(result))
+	for _, migration := range existingMigrations {
+		applied[migration.Id] = struct{}{}
+	}
+	for _, migration := range result {
+		applied[migration.Id] = struct{}{}
+	}
+
+	// Figure out which migrations to apply
+	toApply := ToApply(migrations, record.Id, dir)
+	toApplyCount := len(toApply)
+
+	if version >= 0 {
+		targetIndex := 0
+		for targetIndex < len(toApply) {
+			tempVersion := toApply[targetIndex].VersionInt()
+			if dir == Up && tempVersion > version || dir == Down && tempVersion < version {
+				return nil, newPlanError(&Migration{}, fmt.Errorf("unknown migration with version id %d in database", version).Error())
+			}
+			if tempVersion == version {
+				toApplyCount = targetIndex + 1
+				break
+			}
+			targetIndex++
+		}
+		if targetIndex == len(toApply) {
+			return nil, newPlanError(&Migration{}, fmt.Errorf("unknown migration with version id %d in database", version).Error())
+		}
+	} else if max > 0 && max < toApplyCount {
+		toApplyCount = max
+	}
+	for _, v := range toApply[0:toApplyCount] {
+		if _, ok := applied[v.Id]; dir == Down && !ok {
+			return nil, newPlanError(v, "migration to revert is not applied")
+		}
+		result = append(result, newPlannedMigration(v, dir))
+	}
+
+	return result, nil
+}
+
+// Plans the migration in the given direction.
+func newPlannedMigration(migration *Migration, dir MigrationDirection) *PlannedMigration {
+	if dir == Up {
+		return &PlannedMigration{
+			Migration:          migration,
+			Queries:            migration.Up,
+			DisableTransaction: migration.DisableTransactionUp,
+			up:                 true,
+		}
+	}
+	return &PlannedMigration{
+		Migration:          migration,
+		Queries:            migration.Down,
+		DisableTransaction: migration.DisableTransactionDown,
+	}
+}
+
+// Fails if the source is older than the applied migrations.
+func checkDowngrade(migrations []*Migration, records []*MigrationRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var highest *Migration
+	for _, record := range records {
+		if applied := (&Migration{Id: record.Id}); highest == nil || highest.Less(applied) {
+			highest = applied
+		}
+	}
+	if len(migrations) == 0 || migrations[len(migrations)-1].Less(highest) {
+		return newPlanError(highest, "applied migration is above the highest migration of the source, refusing to downgrade")
+	}
+
+	known := make(map[string]struct{}, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Id] = struct{}{}
+	}
+	for _, record := range records {
+		if _, ok := known[record.Id]; !ok {
+			return newPlanError(&Migration{Id: record.Id}, "applied migration is missing from the source, refusing to downgrade")
+		}
+	}
+
+	return nil
+}
+
+// Fails if migrations planned Down include one which is irreversible or, unless
+// AllowMissingDown is set, has no Down statements.
+func (ms MigrationSet) checkRevertible(dir MigrationDirection, migrations []*PlannedMigration) error {
+	if dir != Down {
+		return nil
+	}
+	for _, migration := range migrations {
+		if migration.catchup {
+			continue
+		}
+		if migration.Irreversible {
+			return newPlanError(migration.Migration, "migration is irreversible")
+		}
+		if !ms.AllowMissingDown && !migration.hasQueries() {
+			return newPlanError(migration.Migration, "migration has no Down statements")
+		}
+	}
+	return nil
+}
+
+// Finds the migrations of the source and validates them against the
+// requirements of the migration set.
+func (ms MigrationSet) findMigrations(m MigrationSource) ([]*Migration, error) {
+	migrations, err := m.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 && ms.RequireMigrations {
+		return nil, ErrEmptySource
+	}
+
+	migrations, errs := ms.applyIdPattern(migrations)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	if errs := ms.checkMigrations(migrations); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	return migrations, nil
+}
+
+// Returns all the problems of the migrations with regard to the options of
+// the set, such as DuplicatePrefixPolicy or RequireUp.
+func (ms MigrationSet) checkMigrations(migrations []*Migration) []error {
+	var errs []error
+	if ms.DuplicatePrefixPolicy == ErrorDuplicatePrefix {
+		prefixes := make(map[string]*Migration, len(migrations))
+		for _, migration := range migrations {
+			prefix := numberPrefix(migration.Id)
+			if prefix == "" {
+				continue
+			}
+			// 05 and 5 are the same version.
+			version := strings.TrimLeft(prefix, "0")
+			if other, ok := prefixes[version]; ok {
+				errs = append(errs, newPlanError(migration, fmt.Sprintf("numeric prefix %s is also used by %s", prefix, other.Id)))
+				continue
+			}
+			prefixes[version] = migration
+		}
+	}
+
+	for _, migration := range migrations {
+		// A notransaction migration failing halfway leaves its first
+		// statements applied, but not recorded.
+		if migration.DisableTransactionUp && migration.statementCount(Up) > 1 || migration.DisableTransactionDown && migration.statementCount(Down) > 1 {
+			if ms.StrictNoTransaction {
+				errs = append(errs, newPlanError(migration, "notransaction migration has several statements"))
+			} else {
+				ms.logf("warning: notransaction migration %s has several statements, it will be left partially applied if one of them fails", migration.Id)
+			}
+		}
+		for _, direction := range []struct {
+			dir           MigrationDirection
+			noTransaction bool
+		}{{Up, migration.DisableTransactionUp}, {Down, migration.DisableTransactionDown}} {
+			if direction.noTransaction {
+				continue
+			}
+			if stmt := migration.transactionControl(direction.dir); stmt != "" {
+				errs = append(errs, newPlanError(migration, fmt.Sprintf("statement %q controls the transaction the migration runs in: remove it, or mark the migration notransaction", stmt)))
+			}
+		}
+		if migration.ContinueOnError && (migration.DisableTransactionUp || migration.DisableTransactionDown) {
+			errs = append(errs, newPlanError(migration, "continueOnError migration cannot use notransaction"))
+		}
+		if ms.RequireUp && !migration.hasStatements(Up) {
+			errs = append(errs, newPlanError(migration, "migration has no Up statements"))
+		}
+		if ms.RequireDown && !migration.hasStatements(Down) {
+			errs = append(errs, newPlanError(migration, "migration has no Down statements"))
+		}
+		if max := ms.MaxStatementsPerMigration; max > 0 && (migration.statementCount(Up) > max || migration.statementCount(Down) > max) {
+			errs = append(errs, newPlanError(migration, fmt.Sprintf("migration has more than %d statements", max)))
+		}
+	}
+
+	return errs
+}
+
+// ValidateSource loads and parses all the migrations of the source, and checks
+// them without a database: every file parses, Ids are unique and sorted, and
+// the options of the set such as RequireDown are satisfied. All the problems
+// found are returned together, which makes it suitable as a pre-merge check.
+func ValidateSource(m MigrationSource) error {
+	return migSet.ValidateSource(m)
+}
+
+func (ms MigrationSet) ValidateSource(m MigrationSource) error {
+	migrations, err := m.FindMigrations()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if len(migrations) == 0 && ms.RequireMigrations {
+		errs = append(errs, ErrEmptySource)
+	}
+	// Ids are checked as planning derives them.
+	migrations, patternErrs := ms.applyIdPattern(migrations)
+	errs = append(errs, patternErrs...)
+	for i, migration := range migrations {
+		if migration.Id == "" {
+			errs = append(errs, newPlanError(migration, "migration has no Id"))
+		}
+		if i == 0 || migrations[i-1].Less(migration) {
+			continue
+		}
+		if migrations[i-1].Id == migration.Id {
+			errs = append(errs, newPlanError(migration, "migration Id is not unique"))
+		} else {
+			errs = append(errs, newPlanError(migration, fmt.Sprintf("migration is not sorted after %s", migrations[i-1].Id)))
+		}
+	}
+
+	errs = append(errs, ms.checkMigrations(migrations)...)
+	return errors.Join(errs...)
+}
+
+// SourceDiff compares two versions of a migration source, such as the one of a
+// pull request against the one of the main branch, without a database. It
+// returns the Ids of the migrations only in b, only in a, and in both with a
+// different Checksum, each in source order.
+func SourceDiff(a, b MigrationSource) (added, removed, modified []string, err error) {
+	before, err := a.FindMigrations()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	after, err := b.FindMigrations()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	checksums := make(map[string]string, len(before))
+	for _, migration := range before {
+		checksums[migration.Id] = migration.Checksum()
+	}
+	kept := make(map[string]struct{}, len(after))
+	for _, migration := range after {
+		kept[migration.Id] = struct{}{}
+		checksum, ok := checksums[migration.Id]
+		if !ok {
+			added = append(added, migration.Id)
+		} else if checksum != migration.Checksum() {
+			modified = append(modified, migration.Id)
+		}
+	}
+	for _, migration := range before {
+		if _, ok := kept[migration.Id]; !ok {
+			removed = append(removed, migration.Id)
+		}
+	}
+
+	return added, removed, modified, nil
+}
+
+// Replaces the Id of the migrations with the one captured by IdPattern, if
+// set, and sorts them by their new Id. The migrations whose name doesn't
+// match, or whose Id is already used, are left out and reported as errors.
+func (ms MigrationSet) applyIdPattern(migrations []*Migration) ([]*Migration, []error) {
+	if ms.IdPattern == nil {
+		return migrations, nil
+	}
+
+	var errs []error
+	result := make([]*Migration, 0, len(migrations))
+	names := make(map[string]string, len(migrations))
+	for _, migration := range migrations {
+		matches := ms.IdPattern.FindStringSubmatch(migration.Id)
+		if len(matches) < 2 || matches[1] == "" {
+			errs = append(errs, newPlanError(migration, fmt.Sprintf("migration name does not match %s", ms.IdPattern)))
+			continue
+		}
+		if name, ok := names[matches[1]]; ok {
+			errs = append(errs, newPlanError(migration, fmt.Sprintf("migration Id %s is also used by %s", matches[1], name)))
+			continue
+		}
+		names[matches[1]] = migration.Id
+
+		renamed := *migration
+		renamed.Id = matches[1]
+		result = append(result, &renamed)
+	}
+	sort.Sort(byId(result))
+
+	return result, errs
+}
+
+// Checks if at least one of the statements is not blank.
+func hasStatements(stmts []string) bool {
+	for _, stmt := range stmts {
+		if strings.TrimSpace(stmt) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first of the statements controlling the transaction, trimmed, or
+// an empty string.
+func transactionControl(stmts []string) string {
+	for _, stmt := range stmts {
+		if isTransactionControl(stmt) {
+			return strings.TrimSpace(stmt)
+		}
+	}
+	return ""
+}
+
+// Filter a slice of migrations into ones that should be applied.
+func ToApply(migrations []*Migration, current string, direction MigrationDirection) []*Migration {
+	var index = -1
+	if current != "" {
+		for index < len(migrations)-1 {
+			index++
+			if migrations[index].Id == current {
+				break
+			}
+		}
+	}
+
+	if direction == Up {
+		return migrations[index+1:]
+	} else if direction == Down {
+		if index == -1 {
+			return []*Migration{}
+		}
+
+		// Add in reverse order
+		toApply := make([]*Migration, index+1)
+		for i := 0; i < index+1; i++ {
+			toApply[index-i] = migrations[i]
+		}
+		return toApply
+	}
+
+	panic("Not possible")
+}
+
+func ToCatchup(migrations, existingMigrations []*Migration, lastRun *Migration) []*PlannedMigration {
+	existing := make(map[string]struct{}, len(existingMigrations))
+	for _, migration := range existingMigrations {
+		existing[migration.Id] = struct{}{}
+	}
+
+	missing := make([]*PlannedMigration, 0)
+	for _, migration := range migrations {
+		if _, found := existing[migration.Id]; !found && migration.Less(lastRun) {
+			missing = append(missing, &PlannedMigration{
+				Migration:          migration,
+				Queries:            migration.Up,
+				DisableTransaction: migration.DisableTransactionUp,
+				up:                 true,
+				catchup:            true,
+			})
+		}
+	}
+	return missing
+}
+
+// GetMigrationRecords returns the records of the applied migrations in the
+// chronological order they were applied, see MigrationRecord.ApplySeq. It
+// includes the records of interrupted migrations, with Dirty set.
+func GetMigrationRecords(ctx context.Context, db Queryer) ([]*MigrationRecord, error) {
+	return migSet.GetMigrationRecords(ctx, db)
+}
+
+func (ms MigrationSet) GetMigrationRecords(ctx context.Context, db Queryer) ([]*MigrationRecord, error) {
+	ctx, cancel := ms.recordsContext(ctx)
+	defer cancel()
+
+	var records []*MigrationRecord
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT id, applied_at, apply_seq, checksum, applied_by, hostname, statements, dirty, duration_ms, run_id FROM %s%s ORDER BY apply_seq ASC, id ASC", ms.quotedTableName(), ms.appliedFilter()))
+	if err != nil {
+		return nil, ms.missingColumnsError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var appliedAt pgtype.Timestamptz
+		var applySeq int64
+		var checksum, appliedBy, hostname, runId pgtype.Text
+		var statements pgtype.Int4
+		var dirty bool
+		var durationMs pgtype.Int8
+
+		if err := rows.Scan(&id, &appliedAt, &applySeq, &checksum, &appliedBy, &hostname, &statements, &dirty, &durationMs, &runId); err != nil {
+			return nil, err
+		}
+		records = append(records, &MigrationRecord{
+			Id:         id,
+			AppliedAt:  appliedAt.Time,
+			ApplySeq:   applySeq,
+			Checksum:   checksum.String,
+			AppliedBy:  appliedBy.String,
+			Hostname:   hostname.String,
+			Statements: int(statements.Int32),
+			Dirty:      dirty,
+			Duration:   time.Duration(durationMs.Int64) * time.Millisecond,
+			RunId:      runId.String,
+		})
+	}
+
+	return records, ms.missingColumnsError(rows.Err())
+}
+
+// GetMigrationRecordsById returns the records of the applied migrations ordered
+// by Id, as migrations are planned. It can differ from the chronological order
+// of GetMigrationRecords when migrations were applied out of order. As the
+// dirty records are neither applied nor pending, it fails with a *DirtyError
+// listing them if there are any, still returning every record.
+func GetMigrationRecordsById(ctx context.Context, db Queryer) ([]*MigrationRecord, error) {
+	return migSet.GetMigrationRecordsById(ctx, db)
+}
+
+func (ms MigrationSet) GetMigrationRecordsById(ctx context.Context, db Queryer) ([]*MigrationRecord, error) {
+	records, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return (&Migration{Id: records[i].Id}).Less(&Migration{Id: records[j].Id})
+	})
+	return records, checkDirtyRecords(records)
+}
+
+// CurrentVersion returns the Id of the highest applied migration, or an empty
+// string if none was applied. It only reads the migration table, so it does
+// not need the migration source and is cheap enough for health endpoints. It
+// fails with a *DirtyError if migrations were interrupted, as planning does.
+func CurrentVersion(ctx context.Context, db Queryer) (string, error) {
+	return migSet.CurrentVersion(ctx, db)
+}
+
+func (ms MigrationSet) CurrentVersion(ctx context.Context, db Queryer) (string, error) {
+	ids, err := ms.appliedIds(ctx, db)
+	if err != nil {
+		return "", err
+	}
+
+	current := &Migration{}
+	for _, id := range ids {
+		if migration := (&Migration{Id: id}); current.Id == "" || current.Less(migration) {
+			current = migration
+		}
+	}
+
+	return current.Id, nil
+}
+
+// SchemaResult is the outcome of an execution on one schema, see
+// MigrationSet.ExecMultiSchema.
+type SchemaResult struct {
+	Schema string
+	// Applied is the number of applied migrations.
+	Applied int
+	Err     error
+}
+
+// Execute a set of migrations on each of the schemas. See
+// MigrationSet.ExecMultiSchema.
+func ExecMultiSchema(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, schemas []string, continueOnError bool) ([]SchemaResult, error) {
+	return migSet.ExecMultiSchema(ctx, db, m, dir, schemas, continueOnError)
+}
+
+// ExecMultiSchema applies the migrations of the source to each of the schemas
+// in turn, such as the schemas of all tenants. Each schema has its own
+// migration table, as if it were the SchemaName of the set, and its
+// migrations run with the schema prepended to the search_path, so that
+// unqualified names resolve to it first, and to the schemas of the previous
+// search_path otherwise, such as public for extension functions.
+//
+// The first failure stops the loop, unless continueOnError is set, in which
+// case the remaining schemas are still migrated. The results of the schemas
+// which were attempted are returned, with the errors of the failed ones
+// joined, each prefixed with its schema.
+func (ms MigrationSet) ExecMultiSchema(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection, schemas []string, continueOnError bool) ([]SchemaResult, error) {
+	results := make([]SchemaResult, 0, len(schemas))
+	var errs []error
+	for _, schema := range schemas {
+		set := ms
+		set.SchemaName = schema
+		set.searchPath = pgx.Identifier{schema}.Sanitize()
+
+		n, err := set.Exec(ctx, db, m, dir)
+		results = append(results, SchemaResult{Schema: schema, Applied: n, Err: err})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("schema %s: %w", schema, err))
+			if !continueOnError {
+				break
+			}
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// SchemaVersions returns the current version, as CurrentVersion does, of the
+// migration table in each of the schemas, such as the schemas of all tenants.
+// The tables are read with a single query. Schemas without a migration table
+// are returned as missing instead. The SchemaName of the set is ignored.
+//
+// Schemas with migrations interrupted while running without a transaction
+// have no version: like CurrentVersion, each of them fails with a *DirtyError,
+// prefixed with its schema and joined into the returned error, while the
+// versions of the other schemas are still returned.
+func SchemaVersions(ctx context.Context, db Queryer, schemas []string) (versions map[string]string, missing []string, err error) {
+	return migSet.SchemaVersions(ctx, db, schemas)
+}
+
+func (ms MigrationSet) SchemaVersions(ctx context.Context, db Queryer, schemas []string) (map[string]string, []string, error) {
+	rows, err := db.Query(ctx, "SELECT schema FROM unnest($1::text[]) AS schema WHERE to_regclass(format('%I.%I', schema, $2::text)) IS NOT NULL", schemas, ms.getTableName())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up migration tables: %w", err)
+	}
+	existing, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up migration tables: %w", err)
+	}
+
+	versions := make(map[string]string, len(existing))
+	var selects []string
+	args := make([]any, 0, len(existing))
+	for _, schema := range existing {
+		versions[schema] = ""
+		args = append(args, schema)
+		query := fmt.Sprintf("SELECT $%d::text, id, dirty FROM %s%s", len(args), pgx.Identifier{schema, ms.getTableName()}.Sanitize(), ms.appliedFilter())
+		selects = append(selects, query)
+	}
+	var missing []string
+	for _, schema := range schemas {
+		if _, ok := versions[schema]; !ok {
+			missing = append(missing, schema)
+		}
+	}
+	if len(selects) == 0 {
+		return versions, missing, nil
+	}
+
+	rows, err = db.Query(ctx, strings.Join(selects, " UNION ALL "), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var schema, id string
+	var dirty bool
+	dirtyIds := make(map[string][]string)
+	_, err = pgx.ForEachRow(rows, []any{&schema, &id, &dirty}, func() error {
+		if dirty {
+			dirtyIds[schema] = append(dirtyIds[schema], id)
+		}
+		if current := versions[schema]; current == "" || (&Migration{Id: current}).Less(&Migration{Id: id}) {
+			versions[schema] = id
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var errs []error
+	for _, schema := range existing {
+		if ids, ok := dirtyIds[schema]; ok {
+			delete(versions, schema)
+			errs = append(errs, fmt.Errorf("schema %s: %w", schema, &DirtyError{Ids: ids}))
+		}
+	}
+	return versions, missing, errors.Join(errs...)
+}
+
+// PendingCount returns the number of migrations of the source which are not
+// applied. Like CurrentVersion, it only reads the migration table, and fails
+// with a *DirtyError if migrations were interrupted.
+func PendingCount(ctx context.Context, db Queryer, m MigrationSource) (int, error) {
+	return migSet.PendingCount(ctx, db, m)
+}
+
+func (ms MigrationSet) PendingCount(ctx context.Context, db Queryer, m MigrationSource) (int, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := ms.appliedIds(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	records := make([]*MigrationRecord, len(ids))
+	for i, id := range ids {
+		records[i] = &MigrationRecord{Id: id}
+	}
+	if records, err = replaceRecords(migrations, records); err != nil {
+		return 0, err
+	}
+	applied := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		applied[record.Id] = struct{}{}
+	}
+
+	pending := 0
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Id]; !ok {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// RecordsSummary is a snapshot of the migration table, see
+// MigrationSet.RecordsSummary.
+type RecordsSummary struct {
+	// Applied is the number of applied migrations.
+	Applied int
+	// LatestId is the Id of the highest applied migration, as returned by
+	// CurrentVersion.
+	LatestId string
+	// OldestAppliedAt and NewestAppliedAt are the earliest and latest times
+	// migrations were applied at. They are zero when none was applied.
+	OldestAppliedAt time.Time
+	NewestAppliedAt time.Time
+	// Orphaned is the number of applied migrations missing from the source.
+	Orphaned int
+}
+
+// GetRecordsSummary returns a snapshot of the migration table. See
+// MigrationSet.RecordsSummary.
+func GetRecordsSummary(ctx context.Context, db Queryer, m MigrationSource) (*RecordsSummary, error) {
+	return migSet.RecordsSummary(ctx, db, m)
+}
+
+// RecordsSummary returns a snapshot of the migration table suitable for
+// monitoring, such as how many migrations are applied and how many of them
+// are orphaned, missing from the source. It is read-only and reads the
+// migration table with a single query.
+func (ms MigrationSet) RecordsSummary(ctx context.Context, db Queryer, m MigrationSource) (*RecordsSummary, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	records, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	known := knownIds(migrations)
+
+	summary := &RecordsSummary{Applied: len(records)}
+	latest := &Migration{}
+	for _, record := range records {
+		if migration := (&Migration{Id: record.Id}); latest.Id == "" || latest.Less(migration) {
+			latest = migration
+		}
+		if summary.OldestAppliedAt.IsZero() || record.AppliedAt.Before(summary.OldestAppliedAt) {
+			summary.OldestAppliedAt = record.AppliedAt
+		}
+		if record.AppliedAt.After(summary.NewestAppliedAt) {
+			summary.NewestAppliedAt = record.AppliedAt
+		}
+		if _, ok := known[record.Id]; !ok {
+			summary.Orphaned++
+		}
+	}
+	summary.LatestId = latest.Id
+
+	return summary, nil
+}
+
+// Returns the WHERE clause selecting the records of applied migrations, see
+// AppliedPredicate. Reverted records are left out whether KeepRevertedRecords
+// is set or not, as a table may keep the ones of earlier executions.
+func (ms MigrationSet) appliedFilter() string {
+	filter := " WHERE reverted_at IS NULL"
+	if ms.AppliedPredicate != "" {
+		filter += " AND (" + ms.AppliedPredicate + ")"
+	}
+	return filter
+}
+
+// Returns the Ids of the applied migrations, from the AppliedIdsCache if set.
+// A missing migration table has none. Fails with a *DirtyError if any of them
+// was interrupted, as it is neither applied nor pending.
+func (ms MigrationSet) appliedIds(ctx context.Context, db Queryer) ([]string, error) {
+	fetch := func() ([]string, error) {
+		rows, err := db.Query(ctx, fmt.Sprintf("SELECT id, dirty FROM %s%s ORDER BY apply_seq ASC", ms.quotedTableName(), ms.appliedFilter()))
+		if err != nil {
+			return nil, ms.missingColumnsError(err)
+		}
+		var ids, dirtyIds []string
+		var id string
+		var dirty bool
+		_, err = pgx.ForEachRow(rows, []any{&id, &dirty}, func() error {
+			ids = append(ids, id)
+			if dirty {
+				dirtyIds = append(dirtyIds, id)
+			}
+			return nil
+		})
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == undefinedTableCode {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, ms.missingColumnsError(err)
+		}
+		if len(dirtyIds) > 0 {
+			return nil, &DirtyError{Ids: dirtyIds}
+		}
+		return ids, nil
+	}
+
+	if ms.AppliedIdsCache == nil {
+		return fetch()
+	}
+	return ms.AppliedIdsCache.get(fetch)
+}
+
+// OrderViolation is a pair of applied migrations whose order of application
+// disagrees with their Id order: Later sorts after Earlier, yet was applied
+// before it.
+type OrderViolation struct {
+	Earlier *MigrationRecord
+	Later   *MigrationRecord
+}
+
+// AuditOrder reports the applied migrations of the source which were applied
+// in a different order than their Ids. It is read-only and purely diagnostic.
+func AuditOrder(ctx context.Context, db Queryer, m MigrationSource) ([]*OrderViolation, error) {
+	return migSet.AuditOrder(ctx, db, m)
+}
+
+func (ms MigrationSet) AuditOrder(ctx context.Context, db Queryer, m MigrationSource) ([]*OrderViolation, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]struct{}, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Id] = struct{}{}
+	}
+
+	migrationRecords, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*MigrationRecord
+	for _, record := range migrationRecords {
+		if _, ok := known[record.Id]; ok {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return (&Migration{Id: records[i].Id}).Less(&Migration{Id: records[j].Id})
+	})
+
+	var violations []*OrderViolation
+	for i, earlier := range records {
+		for _, later := range records[i+1:] {
+			if earlier.AppliedAt.After(later.AppliedAt) {
+				violations = append(violations, &OrderViolation{Earlier: earlier, Later: later})
+			}
+		}
+	}
+
+	return violations, nil
+}
+
+// WaitForDB runs a ping query every interval until it succeeds, which means the
+// database is ready to be migrated, or the context is done.
+func WaitForDB(ctx context.Context, db Queryer, interval time.Duration) error {
+	return migSet.WaitForDB(ctx, db, interval)
+}
+
+func (ms MigrationSet) WaitForDB(ctx context.Context, db Queryer, interval time.Duration) error {
+	query := ms.PingQuery
+	if query == "" {
+		query = "SELECT 1"
+	}
+
+	for {
+		_, err := db.Exec(ctx, query)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database not ready: %w, last error: %s", ctx.Err(), err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// DescribeUnknownMigrations returns the records of applied migrations which are
+// missing from the source, in the order they were applied. These are the
+// migrations IgnoreUnknown would skip over. It is read-only.
+func DescribeUnknownMigrations(ctx context.Context, db Queryer, m MigrationSource) ([]*MigrationRecord, error) {
+	return migSet.DescribeUnknownMigrations(ctx, db, m)
+}
+
+func (ms MigrationSet) DescribeUnknownMigrations(ctx context.Context, db Queryer, m MigrationSource) ([]*MigrationRecord, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	known := knownIds(migrations)
+
+	records, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []*MigrationRecord
+	for _, record := range records {
+		if _, ok := known[record.Id]; !ok {
+			unknown = append(unknown, record)
+		}
+	}
+
+	return unknown, nil
+}
+
+// AppliedSQL returns the statements of the applied migrations, so that the
+// exact subset of the source which produced the schema of the database can be
+// replayed elsewhere. Going Up, these are the Up statements in the order the
+// migrations were applied; going Down, the Down statements in reverse order.
+// It fails with a *PlanError if an applied migration is missing from the
+// source. It is read-only.
+func AppliedSQL(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) ([]string, error) {
+	return migSet.AppliedSQL(ctx, db, m, dir)
+}
+
+func (ms MigrationSet) AppliedSQL(ctx context.Context, db Queryer, m MigrationSource, dir MigrationDirection) ([]string, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]*Migration, len(migrations))
+	for _, migration := range migrations {
+		found[migration.Id] = migration
+	}
+
+	records, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if records, err = replaceRecords(migrations, records); err != nil {
+		return nil, err
+	}
+
+	var statements []string
+	for i := range records {
+		record := records[i]
+		if dir == Down {
+			record = records[len(records)-1-i]
+		}
+		migration, ok := found[record.Id]
+		if !ok {
+			return nil, newPlanError(&Migration{Id: record.Id}, "applied migration missing from source")
+		}
+		err := newPlannedMigration(migration, dir).eachQuery(func(_ int, stmt string) error {
+			statements = append(statements, stmt)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return statements, nil
+}
+
+// SchemaDumper extracts the schema of a database as DDL statements, in the
+// manner of pg_dump --schema-only. The migration table should be left out.
+type SchemaDumper interface {
+	DumpSchema(ctx context.Context, db Queryer) (string, error)
+}
+
+// GenerateBaseline returns a single migration which recreates the current
+// schema of the database, as extracted by dumper, to replace the migrations
+// of the source so that new databases don't replay them. All of them must be
+// applied. The baseline is irreversible, and its Id is the one of the last
+// migration of the source suffixed with "_baseline", so that it sorts after
+// the migrations it replaces.
+//
+// The baseline lists the replaced migrations in Replaces: databases which
+// applied all of them consider the baseline applied, without any record of
+// it, so that executions need neither IgnoreUnknown nor skip the checks of
+// ExecStrict. Saved as a file, the baseline must keep the
+// '-- +migrate replaces' annotations listing them.
+func GenerateBaseline(ctx context.Context, db Queryer, m MigrationSource, dumper SchemaDumper) (*Migration, error) {
+	return migSet.GenerateBaseline(ctx, db, m, dumper)
+}
+
+func (ms MigrationSet) GenerateBaseline(ctx context.Context, db Queryer, m MigrationSource, dumper SchemaDumper) (*Migration, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 {
+		return nil, errors.New("no migrations to generate a baseline from")
+	}
+
+	records, err := ms.GetMigrationRecords(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDirtyRecords(records); err != nil {
+		return nil, err
+	}
+	if records, err = replaceRecords(migrations, records); err != nil {
+		return nil, err
+	}
+	applied := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		applied[record.Id] = struct{}{}
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Id]; !ok {
+			return nil, newPlanError(migration, "migration not applied")
+		}
 	}
 
-	parsed, err := sqlparse.ParseMigration(r)
+	schema, err := dumper.DumpSchema(ctx, db)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing migration (%s): %s", id, err)
+		return nil, fmt.Errorf("failed to dump schema: %w", err)
 	}
 
-	m.Up = parsed.UpStatements
-	m.Down = parsed.DownStatements
-
-	m.DisableTransactionUp = parsed.DisableTransactionUp
-	m.DisableTransactionDown = parsed.DisableTransactionDown
+	baseline := &Migration{
+		Id:           migrations[len(migrations)-1].Id + "_baseline",
+		Irreversible: true,
+	}
+	if strings.TrimSpace(schema) != "" {
+		baseline.Up = append(baseline.Up, schema)
+	}
+	for _, migration := range migrations {
+		baseline.Replaces = append(baseline.Replaces, migration.Id)
+	}
 
-	return m, nil
+	return baseline, nil
 }
 
-// Execute a set of migrations
-//
-// Returns the number of applied migrations.
-func Exec(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection) (int, error) {
-	return ExecMax(ctx, db, m, dir, 0)
+// Returns the Ids of the migrations of the source, and of the ones they
+// replace, see Migration.Replaces.
+func knownIds(migrations []*Migration) map[string]struct{} {
+	known := make(map[string]struct{}, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Id] = struct{}{}
+		for _, id := range migration.Replaces {
+			known[id] = struct{}{}
+		}
+	}
+	return known
 }
 
-// Returns the number of applied migrations.
-func (ms MigrationSet) Exec(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection) (int, error) {
-	return ms.ExecMax(ctx, db, m, dir, 0)
+// Returns the records, with the ones of migrations replaced in the source
+// standing for the record of the migration replacing them once they are all
+// applied, see Migration.Replaces. Fails with a *PlanError if only some of
+// them are applied.
+func replaceRecords(migrations []*Migration, records []*MigrationRecord) ([]*MigrationRecord, error) {
+	replacedBy := make(map[string]*Migration)
+	for _, migration := range migrations {
+		for _, id := range migration.Replaces {
+			replacedBy[id] = migration
+		}
+	}
+	if len(replacedBy) == 0 {
+		return records, nil
+	}
+	recorded := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		recorded[record.Id] = struct{}{}
+	}
+	total := make(map[*Migration]int)
+	for _, migration := range replacedBy {
+		total[migration]++
+	}
+	remaining := make(map[*Migration]int, len(total))
+	for migration, n := range total {
+		remaining[migration] = n
+	}
+
+	result := make([]*MigrationRecord, 0, len(records))
+	for _, record := range records {
+		migration, ok := replacedBy[record.Id]
+		if !ok {
+			result = append(result, record)
+			continue
+		}
+		// The replacing migration was applied when the last of the
+		// replaced ones was.
+		remaining[migration]--
+		if _, ok := recorded[migration.Id]; !ok && remaining[migration] == 0 {
+			replacement := *record
+			replacement.Id = migration.Id
+			replacement.Checksum = ""
+			result = append(result, &replacement)
+		}
+	}
+	for _, migration := range migrations {
+		if n := remaining[migration]; n > 0 && n < total[migration] {
+			return nil, newPlanError(migration, "only some of the migrations it replaces are applied")
+		}
+	}
+
+	return result, nil
 }
 
-// Execute a set of migrations
-//
-// Will apply at most `max` migrations. Pass 0 for no limit (or use Exec).
-//
-// Returns the number of applied migrations.
-func ExecMax(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, max int) (int, error) {
-	return migSet.ExecMax(ctx, db, m, dir, max)
+// RecordApplied records migrations of the source as applied at the given
+// times, without running them, such as when importing the history of another
+// migration tool. See MigrationSet.RecordApplied.
+func RecordApplied(ctx context.Context, db Queryer, m MigrationSource, appliedAt map[string]time.Time) (int, error) {
+	return migSet.RecordApplied(ctx, db, m, appliedAt)
 }
 
-// Execute a set of migrations
+// RecordApplied records the migrations of the source whose Id is in appliedAt
+// as applied at the given time, instead of now, so that imported records keep
+// their original timestamps. They are recorded in the order they were applied,
+// and migrations already recorded are left untouched. Times in the future are
+// recorded anyway, with a warning through the Logger.
 //
-// Will apply at the target `version` of migration. Cannot be a negative value.
-//
-// Returns the number of applied migrations.
-func ExecVersion(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, version int64) (int, error) {
-	if version < 0 {
-		return 0, fmt.Errorf("target version %d should not be negative", version)
+// Returns the number of recorded migrations.
+func (ms MigrationSet) RecordApplied(ctx context.Context, db Queryer, m MigrationSource, appliedAt map[string]time.Time) (int, error) {
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return 0, err
+	}
+	found := make(map[string]*Migration, len(migrations))
+	for _, migration := range migrations {
+		found[migration.Id] = migration
 	}
-	return migSet.ExecVersion(ctx, db, m, dir, version)
-}
 
-// Returns the number of applied migrations.
-func (ms MigrationSet) ExecMax(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, max int) (int, error) {
-	migrations, err := ms.PlanMigration(ctx, db, m, dir, max)
-	if err != nil {
+	var imported []*Migration
+	for id := range appliedAt {
+		migration, ok := found[id]
+		if !ok {
+			return 0, newPlanError(&Migration{Id: id}, "migration not found in source")
+		}
+		imported = append(imported, migration)
+	}
+	sort.Slice(imported, func(i, j int) bool {
+		a, b := appliedAt[imported[i].Id], appliedAt[imported[j].Id]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return imported[i].Less(imported[j])
+	})
+
+	if err := ms.createMigrationTable(ctx, db); err != nil {
 		return 0, err
 	}
-	return ms.applyMigrations(ctx, db, dir, migrations)
-}
 
-// Returns the number of applied migrations.
-func (ms MigrationSet) ExecVersion(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, version int64) (int, error) {
-	migrations, err := ms.PlanMigrationToVersion(ctx, db, m, dir, version)
+	tx, err := db.Begin(ctx)
 	if err != nil {
-		return 0, err
+		return 0, fmt.Errorf("failed to init db transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	recorded := 0
+	for _, migration := range imported {
+		at := appliedAt[migration.Id]
+		if at.After(now) {
+			ms.logf("warning: migration %s is recorded as applied in the future, at %s", migration.Id, at.Format(time.RFC3339))
+		}
+		tag, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id, applied_at, checksum, statements) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING", ms.quotedTableName()), migration.Id, at, migration.Checksum(), migration.statementCount(Up))
+		if err != nil {
+			return 0, fmt.Errorf("failed to record migration %s: %w", migration.Id, err)
+		}
+		recorded += int(tag.RowsAffected())
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit db transaction: %w", err)
 	}
-	return ms.applyMigrations(ctx, db, dir, migrations)
+	return recorded, nil
 }
 
-// Applies the planned migrations and returns the number of applied migrations.
-func (ms MigrationSet) applyMigrations(ctx context.Context, db *pgx.Conn, dir MigrationDirection, migrations []*PlannedMigration) (int, error) {
-	applied := 0
+// Returns a statement recording the migrations as applied, unless they
+// already are.
+// Squash combines the migrations of the source in the inclusive range of Ids
+// into a single migration, so that new databases apply them at once. Its Up
+// runs their Up statements in order, and its Down their Down statements in
+// reverse order. Its Id is the one of the last migration of the range
+// suffixed with "_squashed", and it is irreversible if any of them is.
+// Migrations which can't run in a transaction can't be squashed.
+//
+// The squashed migration lists the migrations of the range in Replaces:
+// databases which applied all of them consider it applied, so that
+// executions need neither IgnoreUnknown nor skip the checks of ExecStrict.
+// Saved as a file, it must keep the '-- +migrate replaces' annotations
+// listing them. SquashRecords can add statements for their bookkeeping on
+// new databases.
+func Squash(m MigrationSource, fromId, toId string) (*Migration, error) {
+	return migSet.Squash(m, fromId, toId)
+}
+
+func (ms MigrationSet) Squash(m MigrationSource, fromId, toId string) (*Migration, error) {
+	from := &Migration{Id: fromId}
+	to := &Migration{Id: toId}
+	if to.Less(from) {
+		return nil, fmt.Errorf("invalid migration range: %s is lower than %s", toId, fromId)
+	}
 
+	migrations, err := ms.findMigrations(m)
+	if err != nil {
+		return nil, err
+	}
+	var squashed []*Migration
 	for _, migration := range migrations {
-		tx, err := db.Begin(ctx)
-		if err != nil {
-			return applied, fmt.Errorf("failed to init db transaction: %s", err.Error())
+		if !migration.Less(from) && !to.Less(migration) {
+			squashed = append(squashed, migration)
 		}
+	}
+	if len(squashed) == 0 || squashed[0].Id != fromId {
+		return nil, newPlanError(from, "migration not found in source")
+	}
+	if squashed[len(squashed)-1].Id != toId {
+		return nil, newPlanError(to, "migration not found in source")
+	}
 
-		for _, stmt := range migration.Queries {
-			if _, err = tx.Exec(ctx, stmt); err != nil {
-				tx.Rollback(ctx)
-				return applied, fmt.Errorf("failed to exec migration statement %q: %s", stmt, err.Error())
-			}
+	last := squashed[len(squashed)-1]
+	result := &Migration{Id: last.Id + "_squashed"}
+	requires := make(map[Requirement]struct{})
+	for _, migration := range squashed {
+		if migration.DisableTransactionUp || migration.DisableTransactionDown {
+			return nil, newPlanError(migration, "notransaction migrations cannot be squashed")
 		}
-
-		switch dir {
-		case Up:
-			if _, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %q (id, applied_at) VALUES ($1, now())", ms.TableName), migration.Id); err != nil {
-				tx.Rollback(ctx)
-				return applied, newTxError(migration, err)
-			}
-		case Down:
-			if _, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %q WHERE id = $1", ms.TableName), migration.Id); err != nil {
-				tx.Rollback(ctx)
-				return applied, newTxError(migration, err)
+		if migration.stream != nil {
+			return nil, newPlanError(migration, "streamed migrations cannot be squashed")
+		}
+		result.Up = append(result.Up, migration.Up...)
+		result.Irreversible = result.Irreversible || migration.Irreversible
+		result.Replaces = append(result.Replaces, migration.Id)
+		for _, r := range migration.Requires {
+			if _, ok := requires[r]; !ok {
+				requires[r] = struct{}{}
+				result.Requires = append(result.Requires, r)
 			}
-		default:
-			panic("Invalid direction")
 		}
-
-		if err := tx.Commit(ctx); err != nil {
-			return applied, newTxError(migration, err)
+	}
+	if !result.Irreversible {
+		for i := len(squashed) - 1; i >= 0; i-- {
+			result.Down = append(result.Down, squashed[i].Down...)
 		}
-
-		applied++
 	}
 
-	return applied, nil
-}
-
-// Plan a migration.
-func PlanMigration(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, max int) ([]*PlannedMigration, error) {
-	return migSet.PlanMigration(ctx, db, m, dir, max)
-}
-
-// Plan a migration to version.
-func PlanMigrationToVersion(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, version int64) ([]*PlannedMigration, error) {
-	return migSet.PlanMigrationToVersion(ctx, db, m, dir, version)
-}
+	if ms.SquashRecords != nil {
+		up, down := ms.SquashRecords(squashed)
+		result.Up = append(result.Up, up...)
+		if !result.Irreversible {
+			result.Down = append(result.Down, down...)
+		}
+	}
 
-// Plan a migration.
-func (ms MigrationSet) PlanMigration(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, max int) ([]*PlannedMigration, error) {
-	return ms.planMigrationCommon(ctx, db, m, dir, max, -1)
+	return result, nil
 }
 
-// Plan a migration to version.
-func (ms MigrationSet) PlanMigrationToVersion(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, version int64) ([]*PlannedMigration, error) {
-	return ms.planMigrationCommon(ctx, db, m, dir, 0, version)
+// Reports whether the migration table exists.
+func (ms MigrationSet) tableExists(ctx context.Context, db Queryer) (bool, error) {
+	var exists bool
+	err := db.QueryRow(ctx, ms.Dialect.tableExistsSQL(), ms.SchemaName, ms.getTableName()).Scan(&exists)
+	return exists, err
 }
 
-// A common method to plan a migration.
-func (ms MigrationSet) planMigrationCommon(ctx context.Context, db *pgx.Conn, m MigrationSource, dir MigrationDirection, max int, version int64) ([]*PlannedMigration, error) {
-	if err := ms.createMigrationTable(ctx, db); err != nil {
-		return nil, err
+// Creates the migration table, or upgrades it if it was created by an earlier
+// version.
+func (ms MigrationSet) createMigrationTable(ctx context.Context, db Queryer) error {
+	if ms.tableChecked {
+		return nil
 	}
+	ctx, cancel := ms.recordsContext(ctx)
+	defer cancel()
 
-	migrations, err := m.FindMigrations()
-	if err != nil {
-		return nil, err
+	if ms.AppliedAtType != "" && ms.AppliedAtType != TimestampTZ && ms.AppliedAtType != Timestamp {
+		return fmt.Errorf("invalid AppliedAtType %q", ms.AppliedAtType)
 	}
 
-	migrationRecords, err := ms.GetMigrationRecords(ctx, db)
+	exists, err := ms.tableExists(ctx, db)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to look up migration table: %s", err.Error())
 	}
-
-	// Sort migrations that have been run by Id.
-	var existingMigrations []*Migration
-	for _, migrationRecord := range migrationRecords {
-		existingMigrations = append(existingMigrations, &Migration{
-			Id: migrationRecord.Id,
-		})
+	if exists && ms.AppliedAtType != "" {
+		if err := ms.checkAppliedAtType(ctx, db); err != nil {
+			return err
+		}
 	}
-	sort.Sort(byId(existingMigrations))
-
-	// Make sure all migrations in the database are among the found migrations which
-	// are to be applied.
-	if !ms.IgnoreUnknown {
-		migrationsSearch := make(map[string]struct{})
-		for _, migration := range migrations {
-			migrationsSearch[migration.Id] = struct{}{}
+	if ms.DisableCreateTable {
+		if !exists {
+			return fmt.Errorf("migration records table %s does not exist and DisableCreateTable is enabled", ms.quotedTableName())
+		}
+		missing, err := ms.missingTableColumns(ctx, db)
+		if err != nil {
+			return err
 		}
-		for _, existingMigration := range existingMigrations {
-			if _, ok := migrationsSearch[existingMigration.Id]; !ok {
-				return nil, newPlanError(existingMigration, "unknown migration in database")
+		if len(missing) > 0 {
+			names := make([]string, len(missing))
+			for i, column := range missing {
+				names[i] = column.Name
 			}
+			return fmt.Errorf("migration records table %s is missing columns %s and DisableCreateTable is enabled, run EnsureTableSchema to add them", ms.quotedTableName(), strings.Join(names, ", "))
 		}
+		return nil
+	}
+	if exists {
+		return ms.upgradeMigrationTable(ctx, db)
 	}
 
-	// Get last migration that was run
-	record := &Migration{}
-	if len(existingMigrations) > 0 {
-		record = existingMigrations[len(existingMigrations)-1]
+	unlogged, tablespace, err := parseTableCreateOptions(ms.TableCreateOptions)
+	if err != nil {
+		return err
 	}
+	if _, err := db.Exec(ctx, fmt.Sprintf(`
+CREATE %sTABLE IF NOT EXISTS %s (
+	PRIMARY KEY (id),
 
-	result := make([]*PlannedMigration, 0)
+	id          TEXT        NOT NULL UNIQUE,
+	applied_at  %-11s NOT NULL DEFAULT now(),
+	apply_seq   BIGSERIAL   NOT NULL,
+	checksum    TEXT,
+	applied_by  TEXT,
+	hostname    TEXT,
+	reverted_at %s,
+	statements  INTEGER,
+	dirty       BOOLEAN     NOT NULL DEFAULT false,
+	duration_ms BIGINT,
+	run_id      TEXT%s
+)%s`, unlogged, ms.quotedTableName(), ms.timestampType(), ms.timestampType(), ms.recordColumnsSQL(), tablespace)); err != nil {
+		return fmt.Errorf("failed to create migration table: %s", err.Error())
+	}
 
-	// Add missing migrations up to the last run migration.
-	// This can happen for example when merges happened.
-	if len(existingMigrations) > 0 {
-		result = append(result, ToCatchup(migrations, existingMigrations, record)...)
+	exists, err = ms.tableExists(ctx, db)
+	if err == nil && !exists {
+		err = errors.New("table not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify migration table %s after creating it: %s", ms.quotedTableName(), err.Error())
 	}
 
-	// Figure out which migrations to apply
-	toApply := ToApply(migrations, record.Id, dir)
-	toApplyCount := len(toApply)
+	return nil
+}
 
-	if version >= 0 {
-		targetIndex := 0
-		for targetIndex < len(toApply) {
-			tempVersion := toApply[targetIndex].VersionInt()
-			if dir == Up && tempVersion > version || dir == Down && tempVersion < version {
-				return nil, newPlanError(&Migration{}, fmt.Errorf("unknown migration with version id %d in database", version).Error())
-			}
-			if tempVersion == version {
-				toApplyCount = targetIndex + 1
-				break
-			}
-			targetIndex++
-		}
-		if targetIndex == len(toApply) {
-			return nil, newPlanError(&Migration{}, fmt.Errorf("unknown migration with version id %d in database", version).Error())
-		}
-	} else if max > 0 && max < toApplyCount {
-		toApplyCount = max
+// Returns the clauses of the CREATE TABLE statement of the migration table
+// set by the TableCreateOptions, failing on options outside of the allowlist.
+func parseTableCreateOptions(options string) (unlogged, tablespace string, err error) {
+	fields := strings.Fields(options)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "UNLOGGED") {
+		unlogged = "UNLOGGED "
+		fields = fields[1:]
 	}
-	for _, v := range toApply[0:toApplyCount] {
-
-		if dir == Up {
-			result = append(result, &PlannedMigration{
-				Migration:          v,
-				Queries:            v.Up,
-				DisableTransaction: v.DisableTransactionUp,
-			})
-		} else if dir == Down {
-			result = append(result, &PlannedMigration{
-				Migration:          v,
-				Queries:            v.Down,
-				DisableTransaction: v.DisableTransactionDown,
-			})
-		}
+	if len(fields) == 2 && strings.EqualFold(fields[0], "TABLESPACE") {
+		tablespace = " TABLESPACE " + pgx.Identifier{fields[1]}.Sanitize()
+		fields = nil
+	}
+	if len(fields) > 0 {
+		return "", "", fmt.Errorf("invalid TableCreateOptions %q: only UNLOGGED and TABLESPACE <name> are supported", options)
 	}
+	return unlogged, tablespace, nil
+}
 
-	return result, nil
+// Returns the type of the timestamps of the migration table.
+func (ms MigrationSet) timestampType() TimestampType {
+	if ms.AppliedAtType == "" {
+		return TimestampTZ
+	}
+	return ms.AppliedAtType
 }
 
-// Filter a slice of migrations into ones that should be applied.
-func ToApply(migrations []*Migration, current string, direction MigrationDirection) []*Migration {
-	var index = -1
-	if current != "" {
-		for index < len(migrations)-1 {
-			index++
-			if migrations[index].Id == current {
-				break
-			}
-		}
+// Fails if the applied_at column of the existing migration table doesn't have
+// the AppliedAtType.
+func (ms MigrationSet) checkAppliedAtType(ctx context.Context, db Queryer) error {
+	var actual string
+	if err := db.QueryRow(ctx, "SELECT atttypid::regtype::text FROM pg_attribute WHERE attrelid = $1::regclass AND attname = 'applied_at' AND NOT attisdropped", ms.quotedTableName()).Scan(&actual); err != nil {
+		return fmt.Errorf("failed to look up migration table applied_at type: %s", err.Error())
+	}
+	if expected := ms.AppliedAtType.catalogName(); actual != expected {
+		return fmt.Errorf("applied_at column of migration table %s is %s, but AppliedAtType is %s", ms.quotedTableName(), actual, expected)
 	}
+	return nil
+}
 
-	if direction == Up {
-		return migrations[index+1:]
-	} else if direction == Down {
-		if index == -1 {
-			return []*Migration{}
-		}
+// Returns the definitions of the RecordColumns, each preceded by a comma.
+func (ms MigrationSet) recordColumnsSQL() string {
+	var sql strings.Builder
+	for _, name := range sortedKeys(ms.RecordColumns) {
+		fmt.Fprintf(&sql, ",\n\t%s %s", pgx.Identifier{name}.Sanitize(), ms.RecordColumns[name])
+	}
+	return sql.String()
+}
 
-		// Add in reverse order
-		toApply := make([]*Migration, index+1)
-		for i := 0; i < index+1; i++ {
-			toApply[index-i] = migrations[i]
-		}
-		return toApply
+// Returns the keys of the map, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	panic("Not possible")
+// Columns added to the migration table since its original layout, in the order
+// they were introduced.
+var migrationTableColumns = []tableColumn{
+	{Name: "apply_seq", Definition: "BIGSERIAL NOT NULL"},
+	{Name: "checksum", Definition: "TEXT"},
+	{Name: "applied_by", Definition: "TEXT"},
+	{Name: "hostname", Definition: "TEXT"},
+	{Name: "reverted_at", Definition: "TIMESTAMPTZ"},
+	{Name: "statements", Definition: "INTEGER"},
+	{Name: "dirty", Definition: "BOOLEAN NOT NULL DEFAULT false"},
+	{Name: "duration_ms", Definition: "BIGINT"},
+	{Name: "run_id", Definition: "TEXT"},
 }
 
-func ToCatchup(migrations, existingMigrations []*Migration, lastRun *Migration) []*PlannedMigration {
-	missing := make([]*PlannedMigration, 0)
-	for _, migration := range migrations {
-		found := false
-		for _, existing := range existingMigrations {
-			if existing.Id == migration.Id {
-				found = true
-				break
+// A column of the migration table.
+type tableColumn struct {
+	Name       string
+	Definition string
+}
+
+// Returns the columns of this version, including the RecordColumns, missing
+// from the existing migration table.
+func (ms MigrationSet) missingTableColumns(ctx context.Context, db Queryer) ([]tableColumn, error) {
+	rows, err := db.Query(ctx, "SELECT attname FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped", ms.quotedTableName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up migration table columns: %s", err.Error())
+	}
+	columns, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up migration table columns: %s", err.Error())
+	}
+	existing := make(map[string]struct{}, len(columns))
+	for _, column := range columns {
+		existing[column] = struct{}{}
+	}
+
+	var missing []tableColumn
+	for _, column := range migrationTableColumns {
+		if _, ok := existing[column.Name]; !ok {
+			if column.Name == "reverted_at" {
+				column.Definition = string(ms.timestampType())
 			}
+			missing = append(missing, column)
 		}
-		if !found && migration.Less(lastRun) {
-			missing = append(missing, &PlannedMigration{
-				Migration:          migration,
-				Queries:            migration.Up,
-				DisableTransaction: migration.DisableTransactionUp,
-			})
+	}
+	for _, name := range sortedKeys(ms.RecordColumns) {
+		if _, ok := existing[name]; !ok {
+			missing = append(missing, tableColumn{Name: name, Definition: ms.RecordColumns[name]})
 		}
 	}
-	return missing
+	return missing, nil
 }
 
-func GetMigrationRecords(ctx context.Context, db *pgx.Conn) ([]*MigrationRecord, error) {
-	return migSet.GetMigrationRecords(ctx, db)
+// Points to EnsureTableSchema when the error was caused by reading a column
+// missing from a migration table created by an earlier version.
+func (ms MigrationSet) missingColumnsError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedColumnCode {
+		return fmt.Errorf("migration records table %s is missing columns of this version, run EnsureTableSchema to add them: %w", ms.quotedTableName(), err)
+	}
+	return err
 }
 
-func (ms MigrationSet) GetMigrationRecords(ctx context.Context, db *pgx.Conn) ([]*MigrationRecord, error) {
-	var records []*MigrationRecord
-	rows, err := db.Query(ctx, fmt.Sprintf("SELECT id, applied_at FROM %q ORDER BY id ASC", ms.getTableName()))
+// EnsureTableSchema adds the columns expected by this version of the package to
+// an existing migration table created by an earlier version. It only adds
+// missing nullable or defaulted columns, so it is idempotent and safe to run
+// on every boot. Executions already do it, unless DisableCreateTable is set,
+// in which case they fail until it was run.
+func EnsureTableSchema(ctx context.Context, db Queryer) error {
+	return migSet.EnsureTableSchema(ctx, db)
+}
+
+func (ms MigrationSet) EnsureTableSchema(ctx context.Context, db Queryer) error {
+	return ms.upgradeMigrationTable(ctx, db)
+}
+
+// Adds the columns missing from migration tables created by earlier versions.
+func (ms MigrationSet) upgradeMigrationTable(ctx context.Context, db Queryer) error {
+	missing, err := ms.missingTableColumns(ctx, db)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var id string
-		var appliedAt pgtype.Timestamptz
+	clauses := make([]string, len(missing))
+	for i, column := range missing {
+		clauses[i] = fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", pgx.Identifier{column.Name}.Sanitize(), column.Definition)
+	}
 
-		if rows.Scan(&id, &appliedAt); err != nil {
-			return nil, err
-		}
-		records = append(records, &MigrationRecord{
-			Id:        id,
-			AppliedAt: appliedAt.Time,
-		})
+	if _, err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s %s", ms.quotedTableName(), strings.Join(clauses, ", "))); err != nil {
+		return fmt.Errorf("failed to upgrade migration table: %s", err.Error())
 	}
 
-	return records, nil
+	return nil
+}
+
+// EnsurePrimaryKey adds a primary key on the id column of the migration table
+// if it has none, which is the case for tables not created by this package.
+// Lookups on large migration tables are slow without it.
+func EnsurePrimaryKey(ctx context.Context, db Queryer) error {
+	return migSet.EnsurePrimaryKey(ctx, db)
 }
 
-func (ms MigrationSet) createMigrationTable(ctx context.Context, db *pgx.Conn) error {
-	if migSet.DisableCreateTable {
+func (ms MigrationSet) EnsurePrimaryKey(ctx context.Context, db Queryer) error {
+	var exists bool
+	if err := db.QueryRow(ctx, `
+SELECT EXISTS (
+	SELECT 1 FROM pg_index WHERE indrelid = $1::regclass AND indisprimary
+)`, ms.quotedTableName()).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up migration table primary key: %s", err.Error())
+	}
+	if exists {
 		return nil
 	}
 
-	if _, err := db.Exec(ctx, fmt.Sprintf(`
-CREATE TABLE IF NOT EXISTS %q (
-	PRIMARY KEY (id),
-
-	id         TEXT        NOT NULL UNIQUE,
-	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
-)`, ms.getTableName())); err != nil {
-		return fmt.Errorf("failed to create migration table: %s", err.Error())
+	if _, err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (id)", ms.quotedTableName())); err != nil {
+		return fmt.Errorf("failed to add migration table primary key: %s", err.Error())
 	}
 
 	return nil
@@ -4,8 +4,14 @@
 package migrate
 
 import (
+	"bytes"
 	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net/http"
+	"path"
+	"sort"
 )
 
 // A set of migrations loaded from an go1.16 embed.FS
@@ -14,10 +20,89 @@ type EmbedFileSystemMigrationSource struct {
 	FileSystem embed.FS
 
 	Root string
+
+	// Extensions of the files to load as migrations. Defaults to ".sql".
+	Extensions []string
 }
 
 var _ MigrationSource = (*EmbedFileSystemMigrationSource)(nil)
 
 func (f EmbedFileSystemMigrationSource) FindMigrations() ([]*Migration, error) {
-	return findMigrations(http.FS(f.FileSystem), f.Root)
+	return findMigrations(http.FS(f.FileSystem), f.Root, f.Extensions, 0)
+}
+
+// A set of migrations loaded from the files of a fs.FS matching a pattern,
+// possibly across nested directories. The Id of each migration is the base
+// name of its file, which must be unique.
+type GlobMigrationSource struct {
+	FileSystem fs.FS
+
+	// Pattern selects the files to load, in the syntax of fs.Glob, such as
+	// "db/*/V*.sql".
+	Pattern string
+
+	// Match selects the files to load instead of Pattern, when set. It is
+	// called with the path of every file of FileSystem, which allows
+	// matchers supporting "**" such as doublestar.Match for patterns like
+	// "db/**/V*.sql".
+	Match func(path string) (bool, error)
+}
+
+var _ MigrationSource = (*GlobMigrationSource)(nil)
+
+func (g GlobMigrationSource) FindMigrations() ([]*Migration, error) {
+	names, err := g.glob()
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]*Migration, 0, len(names))
+	found := make(map[string]string, len(names))
+	var errs []error
+	for _, name := range names {
+		id := path.Base(name)
+		if other, ok := found[id]; ok {
+			return nil, fmt.Errorf("migration %s is both in %s and %s", id, other, name)
+		}
+		found[id] = name
+
+		file, err := fs.ReadFile(g.FileSystem, name)
+		if err != nil {
+			return nil, err
+		}
+		migration, err := ParseMigration(id, bytes.NewReader(file))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error while parsing %s: %s", name, err))
+			continue
+		}
+		migrations = append(migrations, migration)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// Make sure migrations are sorted
+	sort.Sort(byId(migrations))
+
+	return migrations, nil
+}
+
+// Returns the paths of the files selected by Match or Pattern.
+func (g GlobMigrationSource) glob() ([]string, error) {
+	if g.Match == nil {
+		return fs.Glob(g.FileSystem, g.Pattern)
+	}
+
+	var names []string
+	err := fs.WalkDir(g.FileSystem, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		ok, err := g.Match(name)
+		if ok {
+			names = append(names, name)
+		}
+		return err
+	})
+	return names, err
 }
@@ -2,10 +2,17 @@ package migrate
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -353,6 +360,13 @@ func (s *SqliteMigrateSuite) TestMigrateTransaction(c *C) {
 	c.Assert(err, Not(IsNil))
 	c.Assert(n, Equals, 2)
 
+	// The error points at the failing statement.
+	var stmtErr *StatementError
+	c.Assert(errors.As(err, &stmtErr), Equals, true)
+	c.Assert(stmtErr.Migration.Id, Equals, "125")
+	c.Assert(stmtErr.Index, Equals, 1)
+	c.Assert(stmtErr.Statement, Equals, "SELECT fail")
+
 	// INSERT should be rolled back
 	var count int
 	err = s.Db.QueryRow(ctx, "SELECT COUNT(*) FROM people").Scan(&count)
@@ -474,6 +488,17 @@ func (s *SqliteMigrateSuite) TestPlanMigrationWithHoles(c *C) {
 	c.Assert(plannedMigrations[1].Queries[0], Equals, down)
 	c.Assert(plannedMigrations[2].Migration.Id, Equals, "2")
 	c.Assert(plannedMigrations[2].Queries[0], Equals, down)
+
+	// Holes have to be handled explicitly when filling them is disabled.
+	ms := MigrationSet{DisableFillHoles: true}
+	_, err = ms.PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, ErrorMatches, "Unable to create migration plan because of 2: unapplied migration below .*")
+	n, err = ms.ExecRange(ctx, s.Db, migrations, Up, "2", "2")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	plannedMigrations, err = ms.PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(plannedMigrations, HasLen, 2)
 }
 
 func (s *SqliteMigrateSuite) TestLess(c *C) {
@@ -561,9 +586,10 @@ func (s *SqliteMigrateSuite) TestPlanMigrationWithIgnoredUnknownDatabaseMigratio
 			},
 		},
 	}
-	SetIgnoreUnknown(true)
+	ms := DefaultMigrationSet()
+	ms.IgnoreUnknown = true
 	ctx := context.Background()
-	n, err := Exec(ctx, s.Db, migrations, Up)
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
 	c.Assert(err, IsNil)
 	c.Assert(n, Equals, 3)
 
@@ -575,12 +601,18 @@ func (s *SqliteMigrateSuite) TestPlanMigrationWithIgnoredUnknownDatabaseMigratio
 		Down: []string{"ALTER TABLE people DROP COLUMN middle_name"},
 	})
 
-	_, err = PlanMigration(ctx, s.Db, migrations, Up, 0)
+	_, err = ms.PlanMigration(ctx, s.Db, migrations, Up, 0)
 	c.Assert(err, IsNil)
 
-	_, err = PlanMigration(ctx, s.Db, migrations, Down, 0)
-	c.Assert(err, IsNil)
-	SetIgnoreUnknown(false) // Make sure we are not breaking other tests as this is globaly set
+	// 10_add_middle_name.sql sorts after the unknown migration, so reverting
+	// would start with it although it was never applied.
+	_, err = ms.PlanMigration(ctx, s.Db, migrations, Down, 0)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "10_add_middle_name.sql")
+
+	// The package functions still check for unknown migrations.
+	_, err = PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, FitsTypeOf, &PlanError{})
 }
 
 func (s *SqliteMigrateSuite) TestPlanMigrationToVersion(c *C) {
@@ -736,3 +768,2480 @@ func (s *SqliteMigrateSuite) TestSetDisableCreateTable(c *C) {
 	SetDisableCreateTable(false)
 	c.Assert(migSet.DisableCreateTable, Equals, false)
 }
+
+func (s *SqliteMigrateSuite) TestRequireDown(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			testMigrations[0],
+			{
+				Id: "124",
+				Up: []string{"ALTER TABLE people ADD COLUMN first_name text;"},
+			},
+		},
+	}
+
+	ms := MigrationSet{TableName: DefaultMigrationTableName, RequireDown: true}
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "124")
+	c.Assert(n, Equals, 0)
+
+	// Nothing should have been applied
+	_, err = s.Db.Exec(ctx, "SELECT * FROM people")
+	c.Assert(err, NotNil)
+}
+
+func (s *SqliteMigrateSuite) TestRequireUp(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			testMigrations[0],
+			{
+				Id:   "124",
+				Up:   []string{"  \n"},
+				Down: []string{"SELECT 0;"},
+			},
+		},
+	}
+
+	ms := MigrationSet{TableName: DefaultMigrationTableName, RequireUp: true}
+	ctx := context.Background()
+	_, err := ms.PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "124")
+
+	ms.RequireUp = false
+	plannedMigrations, err := ms.PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(plannedMigrations, HasLen, 2)
+}
+
+func (s *SqliteMigrateSuite) TestExecRange(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id:   "20240101120000_create_table.sql",
+				Up:   []string{"CREATE TABLE people (id int)"},
+				Down: []string{"DROP TABLE people"},
+			},
+			{
+				Id:   "20240102120000_add_first_name.sql",
+				Up:   []string{"ALTER TABLE people ADD COLUMN first_name text"},
+				Down: []string{"ALTER TABLE people DROP COLUMN first_name"},
+			},
+			{
+				Id:   "20240103120000_add_last_name.sql",
+				Up:   []string{"ALTER TABLE people ADD COLUMN last_name text"},
+				Down: []string{"ALTER TABLE people DROP COLUMN last_name"},
+			},
+			{
+				Id:   "20240104120000_add_middle_name.sql",
+				Up:   []string{"ALTER TABLE people ADD COLUMN middle_name text"},
+				Down: []string{"ALTER TABLE people DROP COLUMN middle_name"},
+			},
+		},
+	}
+
+	ctx := context.Background()
+
+	// Refuses to skip the unapplied first migration
+	n, err := ExecRange(ctx, s.Db, migrations, Up, "20240102120000", "20240103120000")
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(n, Equals, 0)
+
+	n, err = ExecRange(ctx, s.Db, migrations, Up, "20240101120000", "20240102120000_add_first_name.sql")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	n, err = ExecRange(ctx, s.Db, migrations, Up, "20240103120000", "20240104120000")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	_, err = s.Db.Exec(ctx, "SELECT last_name FROM people")
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, "SELECT middle_name FROM people")
+	c.Assert(err, NotNil)
+
+	// Refuses to revert below an applied migration
+	_, err = ExecRange(ctx, s.Db, migrations, Down, "20240102120000", "20240102130000")
+	c.Assert(err, FitsTypeOf, &PlanError{})
+
+	n, err = ExecRange(ctx, s.Db, migrations, Down, "20240102120000", "20240103130000")
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	_, err = s.Db.Exec(ctx, "SELECT first_name FROM people")
+	c.Assert(err, NotNil)
+}
+
+func (s *SqliteMigrateSuite) TestConnectionLost(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			testMigrations[0],
+			{
+				Id:   "124",
+				Up:   []string{"SELECT pg_terminate_backend(pg_backend_pid())"},
+				Down: []string{"SELECT 0"},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(n, Equals, 1)
+	c.Assert(err, FitsTypeOf, &ConnectionLostError{})
+	c.Assert(err.(*ConnectionLostError).Migration.Id, Equals, "124")
+
+	// The committed migration is not applied again after reconnecting.
+	s.Db, err = pgxConnect()
+	c.Assert(err, IsNil)
+	plannedMigrations, err := PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(plannedMigrations, HasLen, 1)
+	c.Assert(plannedMigrations[0].Id, Equals, "124")
+}
+
+func (s *SqliteMigrateSuite) TestConnectionLostWithPgxPool(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			testMigrations[0],
+			{
+				Id:   "124",
+				Up:   []string{"SELECT pg_terminate_backend(pg_backend_pid())"},
+				Down: []string{"SELECT 0"},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	pool, err := pgxPoolConnect(4)
+	c.Assert(err, IsNil)
+	defer pool.Close()
+
+	n, err := Exec(ctx, pool, migrations, Up)
+	c.Assert(n, Equals, 1)
+	c.Assert(err, FitsTypeOf, &ConnectionLostError{})
+	c.Assert(err.(*ConnectionLostError).Migration.Id, Equals, "124")
+
+	// The pool replaces the lost connection.
+	plannedMigrations, err := PlanMigration(ctx, pool, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(plannedMigrations, HasLen, 1)
+	c.Assert(plannedMigrations[0].Id, Equals, "124")
+}
+
+func (s *SqliteMigrateSuite) TestMigrationTablePrimaryKey(c *C) {
+	ctx := context.Background()
+	hasPrimaryKey := func(table string) bool {
+		var exists bool
+		err := s.Db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_index WHERE indrelid = $1::regclass AND indisprimary)",
+			pgx.Identifier{table}.Sanitize()).Scan(&exists)
+		c.Assert(err, IsNil)
+		return exists
+	}
+
+	ms := MigrationSet{TableName: DefaultMigrationTableName}
+	_, err := ms.Exec(ctx, s.Db, &MemoryMigrationSource{Migrations: testMigrations[:1]}, Up)
+	c.Assert(err, IsNil)
+	c.Assert(hasPrimaryKey(DefaultMigrationTableName), Equals, true)
+
+	// Tables created outside of the package get one added.
+	ms = MigrationSet{TableName: "my migrations", DisableCreateTable: true}
+	_, err = s.Db.Exec(ctx, `CREATE TABLE "my migrations" (id TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`)
+	c.Assert(err, IsNil)
+	c.Assert(hasPrimaryKey("my migrations"), Equals, false)
+
+	c.Assert(ms.EnsurePrimaryKey(ctx, s.Db), IsNil)
+	c.Assert(hasPrimaryKey("my migrations"), Equals, true)
+
+	// Can be called again once the key exists.
+	c.Assert(ms.EnsurePrimaryKey(ctx, s.Db), IsNil)
+
+	// Tear down
+	s.Db.Exec(ctx, `DROP TABLE IF EXISTS "my migrations"`)
+}
+
+// testConnPool hands out the same connection, keeping count of acquisitions.
+// When dial is set, a new connection is opened for every acquisition but the
+// first instead.
+type testConnPool struct {
+	*pgx.Conn
+
+	dial     bool
+	mu       sync.Mutex
+	acquired int
+	released int
+}
+
+func (p *testConnPool) AcquireConn(ctx context.Context) (Queryer, func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.acquired++
+	release := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.released++
+	}
+	if !p.dial || p.acquired == 1 {
+		return p.Conn, release, nil
+	}
+
+	conn, err := pgxConnect()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() {
+		conn.Close(context.Background())
+		release()
+	}, nil
+}
+
+func (s *SqliteMigrateSuite) TestOnAcquireConn(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id:   "1",
+				Up:   []string{"CREATE TABLE people (id int, marker text)"},
+				Down: []string{"DROP TABLE people"},
+			},
+			{
+				Id:   "2",
+				Up:   []string{"INSERT INTO people (id, marker) VALUES (1, current_setting('migrate.marker'))"},
+				Down: []string{"DELETE FROM people"},
+			},
+		},
+	}
+
+	calls := 0
+	ms := MigrationSet{
+		TableName: DefaultMigrationTableName,
+		OnAcquireConn: func(ctx context.Context, conn Queryer) error {
+			calls++
+			_, err := conn.Exec(ctx, "SET migrate.marker = 'session'")
+			return err
+		},
+	}
+	pool := &testConnPool{Conn: s.Db}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, pool, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(calls, Equals, 1)
+	c.Assert(pool.acquired, Equals, 1)
+	c.Assert(pool.released, Equals, 1)
+
+	var marker string
+	err = s.Db.QueryRow(ctx, "SELECT marker FROM people").Scan(&marker)
+	c.Assert(err, IsNil)
+	c.Assert(marker, Equals, "session")
+}
+
+func (s *SqliteMigrateSuite) TestOnProgress(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:2],
+	}
+
+	var progress []string
+	ms := MigrationSet{
+		TableName: DefaultMigrationTableName,
+		OnProgress: func(current, total int, m *Migration) {
+			progress = append(progress, fmt.Sprintf("%d/%d: %s", current, total, m.Id))
+		},
+	}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(progress, DeepEquals, []string{"1/2: 123", "2/2: 124"})
+}
+
+func (s *SqliteMigrateSuite) TestRequirements(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id:       "123",
+				Up:       []string{"CREATE TABLE people (id int)"},
+				Down:     []string{"DROP TABLE people"},
+				Requires: []Requirement{{Kind: RequirementVersion, Value: "9.6"}},
+			},
+			{
+				Id:       "124",
+				Up:       []string{"CREATE INDEX people_id_idx ON people USING gin (id gin_missing_ops)"},
+				Down:     []string{"DROP INDEX people_id_idx"},
+				Requires: []Requirement{{Kind: RequirementExtension, Value: "missing_extension"}},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(n, Equals, 1)
+
+	ms := MigrationSet{TableName: DefaultMigrationTableName, SkipUnmetRequirements: true}
+	n, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	records, err := ms.GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+
+	n, err = ms.Exec(ctx, s.Db, migrations, Down)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *SqliteMigrateSuite) TestRetry(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id:   "1",
+				Up:   []string{"CREATE SEQUENCE people_attempts"},
+				Down: []string{"DROP SEQUENCE people_attempts"},
+			},
+			{
+				Id: "2",
+				// Sequences are not transactional, so this only fails on the first attempt.
+				Up:   []string{"SELECT CASE WHEN nextval('people_attempts') = 1 THEN 1/0 ELSE 1 END"},
+				Down: []string{"SELECT 0"},
+			},
+		},
+	}
+
+	var retried []error
+	ms := MigrationSet{
+		TableName: DefaultMigrationTableName,
+		IsRetryable: func(err error) bool {
+			retried = append(retried, err)
+			return true
+		},
+	}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, NotNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(retried, HasLen, 0)
+
+	_, err = s.Db.Exec(ctx, "SELECT setval('people_attempts', 1, false)")
+	c.Assert(err, IsNil)
+
+	ms.MaxRetries = 1
+	n, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(retried, HasLen, 1)
+
+	// Tear down
+	s.Db.Exec(ctx, "DROP SEQUENCE IF EXISTS people_attempts")
+}
+
+func (s *SqliteMigrateSuite) TestRetryNoTransaction(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id:                   "1",
+				Up:                   []string{"SELECT 1/0"},
+				Down:                 []string{"SELECT 0"},
+				DisableTransactionUp: true,
+			},
+		},
+	}
+
+	var retried []error
+	ms := MigrationSet{
+		TableName:  DefaultMigrationTableName,
+		MaxRetries: 2,
+		IsRetryable: func(err error) bool {
+			retried = append(retried, err)
+			return true
+		},
+	}
+
+	// The dirty record of the first attempt is kept, and its error returned.
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, FitsTypeOf, &StatementError{})
+	c.Assert(n, Equals, 0)
+	c.Assert(retried, HasLen, 0)
+
+	_, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, FitsTypeOf, &DirtyError{})
+}
+
+func (s *SqliteMigrateSuite) TestParallelGroup(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id:   "1",
+				Up:   []string{"CREATE TABLE people (id int)", "CREATE TABLE pets (id int)"},
+				Down: []string{"DROP TABLE pets", "DROP TABLE people"},
+			},
+			{
+				Id:            "2",
+				Up:            []string{"INSERT INTO people (id) SELECT 1 FROM pg_sleep(0.2)"},
+				Down:          []string{"DELETE FROM people"},
+				ParallelGroup: "backfill",
+			},
+			{
+				Id:            "3",
+				Up:            []string{"INSERT INTO pets (id) SELECT 1 FROM pg_sleep(0.2)"},
+				Down:          []string{"DELETE FROM pets"},
+				ParallelGroup: "backfill",
+			},
+			{
+				Id:            "4",
+				Up:            []string{"SELECT fail"},
+				Down:          []string{"SELECT 0"},
+				ParallelGroup: "backfill",
+			},
+		},
+	}
+
+	ctx := context.Background()
+	pool := &testConnPool{Conn: s.Db, dial: true}
+	n, err := Exec(ctx, pool, migrations, Up)
+	c.Assert(err, NotNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(pool.acquired, Equals, 4)
+	c.Assert(pool.released, Equals, 4)
+
+	var count int
+	err = s.Db.QueryRow(ctx, "SELECT (SELECT COUNT(*) FROM people) + (SELECT COUNT(*) FROM pets)").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+
+	// Tear down
+	s.Db.Exec(ctx, "DROP TABLE IF EXISTS pets")
+}
+
+func (s *SqliteMigrateSuite) TestParallelGroupSingleConn(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"INSERT INTO people (id) VALUES (1)"}, Down: []string{"DELETE FROM people WHERE id = 1"}, ParallelGroup: "backfill"},
+			{Id: "3", Up: []string{"INSERT INTO people (id) VALUES (2)"}, Down: []string{"DELETE FROM people WHERE id = 2"}, ParallelGroup: "backfill"},
+		},
+	}
+
+	pool, err := pgxPoolConnect(1)
+	c.Assert(err, IsNil)
+	defer pool.Close()
+
+	// The group is applied on the held connection, instead of waiting for
+	// another one.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n, err := Exec(ctx, pool, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	var count int
+	err = s.Db.QueryRow(ctx, "SELECT COUNT(*) FROM people").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+}
+
+func (s *SqliteMigrateSuite) TestAuditOrder(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "0008", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "0009", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "0010", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	violations, err := AuditOrder(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 0)
+
+	// 0010 was applied before 0009.
+	_, err = s.Db.Exec(ctx, fmt.Sprintf("UPDATE %s SET applied_at = now() + interval '1 hour' WHERE id = '0009'", DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+
+	violations, err = AuditOrder(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 1)
+	c.Assert(violations[0].Earlier.Id, Equals, "0009")
+	c.Assert(violations[0].Later.Id, Equals, "0010")
+}
+
+func (s *SqliteMigrateSuite) TestCurrentVersion(c *C) {
+	ctx := context.Background()
+	version, err := CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, "")
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "9_people", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "10_pets", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+	_, err = Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	version, err = CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, "10_pets")
+}
+
+func (s *SqliteMigrateSuite) TestAppliedIdsCache(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+	ms := MigrationSet{AppliedIdsCache: NewAppliedIdsCache(time.Hour)}
+
+	ctx := context.Background()
+	_, err := ms.ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+
+	pending, err := ms.PendingCount(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(pending, Equals, 2)
+
+	// Changes made elsewhere are not seen until the cache expires.
+	_, err = ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+	pending, err = ms.PendingCount(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(pending, Equals, 2)
+	version, err := ms.CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, "1")
+
+	// Executions invalidate it.
+	_, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	pending, err = ms.PendingCount(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(pending, Equals, 0)
+	version, err = ms.CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, "3")
+
+	// Without a cache, every call queries the migration table.
+	_, err = ExecMax(ctx, s.Db, migrations, Down, 1)
+	c.Assert(err, IsNil)
+	pending, err = PendingCount(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(pending, Equals, 1)
+}
+
+func (s *SqliteMigrateSuite) TestTryExec(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:2],
+	}
+
+	ctx := context.Background()
+	n, err := TryExec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	// Nothing was persisted
+	_, err = s.Db.Exec(ctx, "SELECT * FROM people")
+	c.Assert(err, NotNil)
+
+	migrations.Migrations = append(migrations.Migrations, &Migration{
+		Id:   "125",
+		Up:   []string{"ALTER TABLE people ADD COLUMN first_name text"},
+		Down: []string{"ALTER TABLE people DROP COLUMN first_name"},
+	})
+	n, err = TryExec(ctx, s.Db, migrations, Up)
+	c.Assert(err, NotNil)
+	c.Assert(n, Equals, 2)
+
+	n, err = Exec(ctx, s.Db, &MemoryMigrationSource{Migrations: testMigrations[:2]}, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *SqliteMigrateSuite) TestStreamedMigration(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "1_people.sql"), []byte("-- +migrate Up\nCREATE TABLE people (id int);\nINSERT INTO people VALUES (1);\n\n-- +migrate Down\nDROP TABLE people;\n"), 0o644), IsNil)
+	migrations := &FileMigrationSource{Dir: dir, StreamThreshold: 1}
+
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	var count int
+	err = s.Db.QueryRow(ctx, "SELECT count(*) FROM people").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Statements, Equals, 2)
+
+	n, err = Exec(ctx, s.Db, migrations, Down)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	_, err = s.Db.Exec(ctx, "SELECT * FROM people")
+	c.Assert(err, NotNil)
+}
+
+func (s *SqliteMigrateSuite) TestRunInRollback(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:2],
+	}
+
+	ctx := context.Background()
+	err := RunInRollback(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+
+	// Nothing was persisted
+	_, err = s.Db.Exec(ctx, "SELECT * FROM people")
+	c.Assert(err, NotNil)
+
+	// Down statements are exercised too.
+	migrations.Migrations = append(migrations.Migrations, &Migration{
+		Id:   "125",
+		Up:   []string{"ALTER TABLE people ADD COLUMN last_name text"},
+		Down: []string{"ALTER TABLE people DROP COLUMN middle_name"},
+	})
+	err = RunInRollback(ctx, s.Db, migrations)
+	c.Assert(err, FitsTypeOf, &StatementError{})
+	c.Assert(err.(*StatementError).Migration.Id, Equals, "125")
+
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+}
+
+func (s *SqliteMigrateSuite) TestVerifyReversibleStrict(c *C) {
+	snapshot := func(ctx context.Context, db Queryer) (map[string]string, error) {
+		rows, err := db.Query(ctx, "SELECT table_name || '.' || column_name, data_type FROM information_schema.columns WHERE table_schema = 'public' AND table_name <> $1", DefaultMigrationTableName)
+		if err != nil {
+			return nil, err
+		}
+		columns := make(map[string]string)
+		var name, dataType string
+		_, err = pgx.ForEachRow(rows, []any{&name, &dataType}, func() error {
+			columns[name] = dataType
+			return nil
+		})
+		return columns, err
+	}
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:2],
+	}
+
+	ctx := context.Background()
+	err := VerifyReversibleStrict(ctx, s.Db, migrations, snapshot)
+	c.Assert(err, IsNil)
+
+	// Nothing was persisted
+	_, err = s.Db.Exec(ctx, "SELECT * FROM people")
+	c.Assert(err, NotNil)
+
+	// The Down runs, but leaves the column behind.
+	migrations.Migrations = append(migrations.Migrations, &Migration{
+		Id:   "125",
+		Up:   []string{"ALTER TABLE people ADD COLUMN last_name text"},
+		Down: []string{"SELECT 0"},
+	})
+	err = VerifyReversibleStrict(ctx, s.Db, migrations, snapshot)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "125")
+	c.Assert(err, ErrorMatches, ".*Down does not reverse Up, divergent objects: people.last_name")
+}
+
+func (s *SqliteMigrateSuite) TestApplySeq(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	// Fill in the hole, which is applied after 3.
+	migrations.Migrations = append(migrations.Migrations, &Migration{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}})
+	_, err = Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	c.Assert(records[0].Id, Equals, "1")
+	c.Assert(records[1].Id, Equals, "3")
+	c.Assert(records[2].Id, Equals, "2")
+	c.Assert(records[0].ApplySeq < records[1].ApplySeq, Equals, true)
+	c.Assert(records[1].ApplySeq < records[2].ApplySeq, Equals, true)
+}
+
+func (s *SqliteMigrateSuite) TestGetMigrationRecordsById(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "10", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	// Fill in a hole, which is applied last.
+	migrations.Migrations = append(migrations.Migrations, &Migration{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}})
+	_, err = Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	c.Assert(records[2].Id, Equals, "2")
+
+	records, err = GetMigrationRecordsById(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	c.Assert(records[0].Id, Equals, "1")
+	c.Assert(records[1].Id, Equals, "2")
+	c.Assert(records[2].Id, Equals, "10")
+}
+
+func (s *SqliteMigrateSuite) TestApplySeqUpgrade(c *C) {
+	ctx := context.Background()
+	_, err := s.Db.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s (id TEXT NOT NULL PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`, DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (id) VALUES ('1')`, DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[1].Id, Equals, "2")
+}
+
+func (s *SqliteMigrateSuite) TestEnsureTableSchema(c *C) {
+	ctx := context.Background()
+	_, err := s.Db.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s (id TEXT NOT NULL PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())`, DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (id) VALUES ('1')`, DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+
+	// Tables that aren't upgraded by executions point to EnsureTableSchema.
+	ms := MigrationSet{DisableCreateTable: true}
+	_, err = ms.Exec(ctx, s.Db, &MemoryMigrationSource{Migrations: testMigrations}, Up)
+	c.Assert(err, ErrorMatches, `migration records table "migration_info" is missing columns apply_seq, checksum, .*, run_id and DisableCreateTable is enabled, run EnsureTableSchema to add them`)
+	_, err = GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, ErrorMatches, `migration records table "migration_info" is missing columns of this version, run EnsureTableSchema to add them: .*`)
+
+	err = EnsureTableSchema(ctx, s.Db)
+	c.Assert(err, IsNil)
+	err = EnsureTableSchema(ctx, s.Db)
+	c.Assert(err, IsNil)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Id, Equals, "1")
+	c.Assert(records[0].Checksum, Equals, "")
+}
+
+func (s *SqliteMigrateSuite) TestRecordDuration(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT pg_sleep(0.05)"}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{"SELECT pg_sleep(0.05)"}, Down: []string{"SELECT 0"}, DisableTransactionUp: true},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+
+	ms := MigrationSet{RecordDuration: true}
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	c.Assert(records[0].Duration, Equals, time.Duration(0))
+	c.Assert(records[1].Duration >= 50*time.Millisecond, Equals, true)
+	c.Assert(records[2].Duration >= 50*time.Millisecond, Equals, true)
+}
+
+func (s *SqliteMigrateSuite) TestMaxClockSkew(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	logger := &recordingLogger{}
+	ms := MigrationSet{MaxClockSkew: time.Hour, Logger: logger}
+	_, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(logger.messages, HasLen, 0)
+
+	// No two clocks agree to the nanosecond.
+	ms.MaxClockSkew = time.Nanosecond
+	_, err = ms.Exec(ctx, s.Db, migrations, Down)
+	c.Assert(err, IsNil)
+	c.Assert(logger.messages, HasLen, 1)
+	c.Assert(logger.messages[0], Matches, `run .*: warning: database clock differs from local clock by .*`)
+}
+
+func (s *SqliteMigrateSuite) TestRecordApplied(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	first := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	second := time.Date(2020, 6, 15, 8, 30, 0, 0, time.UTC)
+	future := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	logger := &recordingLogger{}
+	ms := MigrationSet{Logger: logger}
+
+	n, err := ms.RecordApplied(ctx, s.Db, migrations, map[string]time.Time{"2": first, "1": second, "3": future})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(logger.messages, HasLen, 1)
+	c.Assert(logger.messages[0], Matches, "warning: migration 3 is recorded as applied in the future, .*")
+
+	// Records follow the original order of application.
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	c.Assert(records[0].Id, Equals, "2")
+	c.Assert(records[0].AppliedAt.Equal(first), Equals, true)
+	c.Assert(records[1].Id, Equals, "1")
+	c.Assert(records[1].AppliedAt.Equal(second), Equals, true)
+	c.Assert(records[2].AppliedAt.Equal(future), Equals, true)
+
+	// Nothing was run, and recorded migrations are left untouched.
+	_, err = s.Db.Exec(ctx, "SELECT * FROM people")
+	c.Assert(err, NotNil)
+	n, err = ms.RecordApplied(ctx, s.Db, migrations, map[string]time.Time{"1": first})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	_, err = ms.RecordApplied(ctx, s.Db, migrations, map[string]time.Time{"4": first})
+	c.Assert(err, FitsTypeOf, &PlanError{})
+}
+
+func (s *SqliteMigrateSuite) TestRole(c *C) {
+	ctx := context.Background()
+	var login string
+	err := s.Db.QueryRow(ctx, "SELECT current_user").Scan(&login)
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, "CREATE ROLE sql_migrate_ddl")
+	c.Assert(err, IsNil)
+	defer s.Db.Exec(ctx, "DROP ROLE sql_migrate_ddl")
+	_, err = s.Db.Exec(ctx, "GRANT CREATE ON SCHEMA public TO sql_migrate_ddl")
+	c.Assert(err, IsNil)
+	defer s.Db.Exec(ctx, "REVOKE CREATE ON SCHEMA public FROM sql_migrate_ddl")
+	defer s.Db.Exec(ctx, "DROP TABLE IF EXISTS people, posts")
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"CREATE TABLE posts (id int)"}, Down: []string{"DROP TABLE posts"}, DisableTransactionUp: true},
+		},
+	}
+	ms := MigrationSet{Role: "sql_migrate_ddl", RecordsRole: login}
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	for _, table := range []string{"people", "posts"} {
+		var owner string
+		err = s.Db.QueryRow(ctx, "SELECT tableowner FROM pg_tables WHERE tablename = $1", table).Scan(&owner)
+		c.Assert(err, IsNil)
+		c.Assert(owner, Equals, "sql_migrate_ddl")
+	}
+
+	// The role of the connection is restored.
+	var current string
+	err = s.Db.QueryRow(ctx, "SELECT current_user").Scan(&current)
+	c.Assert(err, IsNil)
+	c.Assert(current, Equals, login)
+}
+
+func (s *SqliteMigrateSuite) TestRoleOfSession(c *C) {
+	ctx := context.Background()
+	var login string
+	err := s.Db.QueryRow(ctx, "SELECT current_user").Scan(&login)
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, "CREATE ROLE sql_migrate_ddl")
+	c.Assert(err, IsNil)
+	defer s.Db.Exec(ctx, "DROP ROLE sql_migrate_ddl")
+	_, err = s.Db.Exec(ctx, "GRANT CREATE ON SCHEMA public TO sql_migrate_ddl")
+	c.Assert(err, IsNil)
+	defer s.Db.Exec(ctx, "REVOKE CREATE ON SCHEMA public FROM sql_migrate_ddl")
+	defer s.Db.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS people, posts, %s", DefaultMigrationTableName))
+	defer s.Db.Exec(ctx, "RESET ROLE")
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}, DisableTransactionUp: true},
+			{Id: "2", Up: []string{"CREATE TABLE posts (id int)"}, Down: []string{"DROP TABLE posts"}},
+		},
+	}
+	// Only the records are written under another role, the migrations run
+	// under the role of the session.
+	ms := MigrationSet{
+		RecordsRole: login,
+		OnAcquireConn: func(ctx context.Context, conn Queryer) error {
+			_, err := conn.Exec(ctx, "SET ROLE sql_migrate_ddl")
+			return err
+		},
+	}
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	for _, table := range []string{"people", "posts"} {
+		var owner string
+		err = s.Db.QueryRow(ctx, "SELECT tableowner FROM pg_tables WHERE tablename = $1", table).Scan(&owner)
+		c.Assert(err, IsNil)
+		c.Assert(owner, Equals, "sql_migrate_ddl")
+	}
+
+	var current string
+	err = s.Db.QueryRow(ctx, "SELECT current_user").Scan(&current)
+	c.Assert(err, IsNil)
+	c.Assert(current, Equals, "sql_migrate_ddl")
+}
+
+func (s *SqliteMigrateSuite) TestNotifyChannel(c *C) {
+	ctx := context.Background()
+	listener, err := pgxConnect()
+	c.Assert(err, IsNil)
+	defer listener.Close(ctx)
+	_, err = listener.Exec(ctx, "LISTEN schema_changes")
+	c.Assert(err, IsNil)
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 1/0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+	ms := MigrationSet{NotifyChannel: "schema_changes"}
+	_, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, NotNil)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	notification, err := listener.WaitForNotification(waitCtx)
+	c.Assert(err, IsNil)
+	c.Assert(notification.Channel, Equals, "schema_changes")
+	c.Assert(notification.Payload, Equals, "1")
+
+	// The failed migration was rolled back with its notification.
+	waitCtx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = listener.WaitForNotification(waitCtx)
+	c.Assert(err, NotNil)
+}
+
+func (s *SqliteMigrateSuite) TestAppliedPredicate(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:2],
+	}
+	ms := MigrationSet{
+		RecordColumns:    map[string]string{"status": "TEXT NOT NULL DEFAULT 'applied'"},
+		AppliedPredicate: "status = 'applied'",
+	}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	// The second migration is soft-reverted by other tooling.
+	_, err = s.Db.Exec(ctx, fmt.Sprintf("UPDATE %s SET status = 'reverted' WHERE id = $1", DefaultMigrationTableName), testMigrations[1].Id)
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, "ALTER TABLE people DROP COLUMN first_name")
+	c.Assert(err, IsNil)
+
+	version, err := ms.CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, testMigrations[0].Id)
+	planned, err := ms.PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(planned, HasLen, 1)
+	c.Assert(planned[0].Id, Equals, testMigrations[1].Id)
+
+	// Without the predicate, every record is applied.
+	version, err = CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, testMigrations[1].Id)
+
+	// Applying the soft-reverted migration again replaces its record.
+	n, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	version, err = ms.CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, testMigrations[1].Id)
+	planned, err = ms.PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(planned, HasLen, 0)
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+}
+
+func (s *SqliteMigrateSuite) TestUnloggedTable(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:1],
+	}
+	ms := MigrationSet{TableCreateOptions: "UNLOGGED"}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	var persistence string
+	err = s.Db.QueryRow(ctx, "SELECT relpersistence::text FROM pg_class WHERE oid = $1::regclass", DefaultMigrationTableName).Scan(&persistence)
+	c.Assert(err, IsNil)
+	c.Assert(persistence, Equals, "u")
+}
+
+func (s *SqliteMigrateSuite) TestRecordsSummary(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "10", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "11", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	first := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := RecordApplied(ctx, s.Db, migrations, map[string]time.Time{"1": first, "2": last, "10": first.Add(time.Hour)})
+	c.Assert(err, IsNil)
+
+	// Migration 1 was removed from the source since.
+	summary, err := GetRecordsSummary(ctx, s.Db, &MemoryMigrationSource{Migrations: migrations.Migrations[1:]})
+	c.Assert(err, IsNil)
+	c.Assert(summary.Applied, Equals, 3)
+	c.Assert(summary.LatestId, Equals, "10")
+	c.Assert(summary.OldestAppliedAt.Equal(first), Equals, true)
+	c.Assert(summary.NewestAppliedAt.Equal(last), Equals, true)
+	c.Assert(summary.Orphaned, Equals, 1)
+}
+
+func (s *SqliteMigrateSuite) TestRunId(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}, DisableTransactionUp: true},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	ms := MigrationSet{RecordRunId: true}
+	result, err := ms.ExecMaxResult(ctx, s.Db, migrations, Up, 2)
+	c.Assert(err, IsNil)
+	c.Assert(result.RunId, Matches, `[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
+
+	ms.RunId = "deploy-42"
+	_, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	c.Assert(records[0].RunId, Equals, result.RunId)
+	c.Assert(records[1].RunId, Equals, result.RunId)
+	c.Assert(records[2].RunId, Equals, "deploy-42")
+}
+
+func (s *SqliteMigrateSuite) TestRecordProvenance(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+
+	ms := MigrationSet{RecordProvenance: true, Actor: "deploy-bot"}
+	_, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	hostname, err := os.Hostname()
+	c.Assert(err, IsNil)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].AppliedBy, Equals, "")
+	c.Assert(records[0].Hostname, Equals, "")
+	c.Assert(records[1].AppliedBy, Equals, "deploy-bot")
+	c.Assert(records[1].Hostname, Equals, hostname)
+}
+
+func (s *SqliteMigrateSuite) TestIrreversible(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Irreversible: true},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	// Reverting down to the irreversible migration is fine.
+	n, err := ExecMax(ctx, s.Db, migrations, Down, 1)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	n, err = Exec(ctx, s.Db, migrations, Down)
+	c.Assert(n, Equals, 0)
+	planErr, ok := err.(*PlanError)
+	c.Assert(ok, Equals, true)
+	c.Assert(planErr.Migration.Id, Equals, "2")
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+}
+
+type staticSchemaDumper string
+
+func (d staticSchemaDumper) DumpSchema(ctx context.Context, db Queryer) (string, error) {
+	return string(d), nil
+}
+
+func (s *SqliteMigrateSuite) TestGenerateBaseline(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+	dumper := staticSchemaDumper("CREATE TABLE people (id int, first_name text);")
+
+	ctx := context.Background()
+	_, err := ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+
+	// Pending migrations are not part of the schema.
+	_, err = GenerateBaseline(ctx, s.Db, migrations, dumper)
+	c.Assert(err, NotNil)
+
+	_, err = Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	baseline, err := GenerateBaseline(ctx, s.Db, migrations, dumper)
+	c.Assert(err, IsNil)
+	c.Assert(baseline.Id, Equals, "124_baseline")
+	c.Assert(baseline.Irreversible, Equals, true)
+	c.Assert(baseline.Up, HasLen, 1)
+	c.Assert(baseline.Replaces, DeepEquals, []string{"123", "124"})
+	swapped := &MemoryMigrationSource{Migrations: []*Migration{baseline}}
+
+	// Databases which applied the replaced migrations have the baseline
+	// applied, and pass every check after the swap.
+	result, err := ExecStrict(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 0)
+	c.Assert(result.MoreAvailable, Equals, false)
+	pending, err := PendingCount(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(pending, Equals, 0)
+	unknown, err := DescribeUnknownMigrations(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(unknown, HasLen, 0)
+
+	// A later baseline can be generated from a source holding this one.
+	next := &MemoryMigrationSource{Migrations: []*Migration{
+		baseline,
+		{Id: "125", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+	}}
+	_, err = Exec(ctx, s.Db, next, Up)
+	c.Assert(err, IsNil)
+	nextBaseline, err := GenerateBaseline(ctx, s.Db, next, dumper)
+	c.Assert(err, IsNil)
+	c.Assert(nextBaseline.Replaces, DeepEquals, []string{"124_baseline", "125"})
+
+	// Interrupted migrations are not part of the schema either.
+	_, err = s.Db.Exec(ctx, fmt.Sprintf("UPDATE %s SET dirty = true WHERE id = '125'", DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+	_, err = GenerateBaseline(ctx, s.Db, next, dumper)
+	c.Assert(err, FitsTypeOf, &DirtyError{})
+
+	// New databases get the schema from the baseline alone.
+	_, err = s.Db.Exec(ctx, "DROP TABLE people")
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, fmt.Sprintf("DROP TABLE %s", DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+
+	result, err = ExecStrict(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+
+	_, err = s.Db.Exec(ctx, "SELECT first_name FROM people")
+	c.Assert(err, IsNil)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Id, Equals, "124_baseline")
+	result, err = ExecStrict(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 0)
+}
+
+func (s *SqliteMigrateSuite) TestSquash(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"ALTER TABLE people ADD first_name text"}, Down: []string{"ALTER TABLE people DROP first_name"}},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	squashed, err := Squash(migrations, "1", "2")
+	c.Assert(err, IsNil)
+	swapped := &MemoryMigrationSource{Migrations: []*Migration{squashed, migrations.Migrations[2]}}
+
+	// Databases which applied the range have the squashed migration
+	// applied, without IgnoreUnknown.
+	result, err := ExecStrict(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 0)
+	pending, err := PendingCount(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(pending, Equals, 0)
+
+	// Reverting it deletes the records of the range.
+	n, err := Exec(ctx, s.Db, swapped, Down)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+
+	// New databases apply it once.
+	result, err = ExecStrict(ctx, s.Db, swapped)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 2)
+	_, err = s.Db.Exec(ctx, "SELECT first_name FROM people")
+	c.Assert(err, IsNil)
+}
+
+func (s *SqliteMigrateSuite) TestRefuseDowngrade(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	ms := MigrationSet{IgnoreUnknown: true, RefuseDowngrade: true}
+
+	// An older source.
+	_, err = ms.Exec(ctx, s.Db, &MemoryMigrationSource{Migrations: migrations.Migrations[:2]}, Up)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "3")
+
+	// A source missing an applied migration.
+	_, err = ms.Exec(ctx, s.Db, &MemoryMigrationSource{Migrations: []*Migration{migrations.Migrations[0], migrations.Migrations[2]}}, Up)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "2")
+
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *SqliteMigrateSuite) TestAdvisoryLockTimeout(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:1],
+	}
+	ms := MigrationSet{UseAdvisoryLock: true}
+
+	// Another execution holds the lock.
+	holder, err := pgxConnect()
+	c.Assert(err, IsNil)
+	defer holder.Close(context.Background())
+	_, err = holder.Exec(context.Background(), "SELECT pg_advisory_lock($1)", ms.lockKey())
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(n, Equals, 0)
+	c.Assert(err, FitsTypeOf, &LockTimeoutError{})
+	c.Assert(err.(*LockTimeoutError).Waited > 0, Equals, true)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+
+	_, err = holder.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", ms.lockKey())
+	c.Assert(err, IsNil)
+
+	n, err = ms.Exec(context.Background(), s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// The lock is released after the execution.
+	var locked bool
+	err = holder.QueryRow(context.Background(), "SELECT pg_try_advisory_lock($1)", ms.lockKey()).Scan(&locked)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+}
+
+func (s *SqliteMigrateSuite) TestAdvisoryLockReplans(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT pg_sleep(0.5)"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+	ms := MigrationSet{UseAdvisoryLock: true}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	run := func(applied *[]*PlannedMigration, err *error) {
+		defer wg.Done()
+		conn, connErr := pgxConnect()
+		if connErr != nil {
+			*err = connErr
+			return
+		}
+		defer conn.Close(ctx)
+		*applied, *err = ms.ExecWithPlan(ctx, conn, migrations, Up)
+	}
+
+	var first, second []*PlannedMigration
+	var firstErr, secondErr error
+	wg.Add(1)
+	go run(&first, &firstErr)
+
+	// Start the second execution once the first one holds the lock.
+	for locked := false; !locked; {
+		err := s.Db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND granted)").Scan(&locked)
+		c.Assert(err, IsNil)
+	}
+	wg.Add(1)
+	go run(&second, &secondErr)
+	wg.Wait()
+
+	c.Assert(firstErr, IsNil)
+	c.Assert(first, HasLen, 2)
+	// The second execution planned after the first one released the lock.
+	c.Assert(secondErr, IsNil)
+	c.Assert(second, HasLen, 0)
+}
+
+func (s *SqliteMigrateSuite) TestAdvisoryLockWithPool(c *C) {
+	heldLock := "INSERT INTO lock_checks SELECT pg_backend_pid(), EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted)"
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE lock_checks (pid int, locked bool)"}, Down: []string{"DROP TABLE lock_checks"}},
+			{Id: "2", Up: []string{heldLock}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{heldLock}, Down: []string{"SELECT 0"}},
+		},
+	}
+	ms := MigrationSet{UseAdvisoryLock: true}
+	// Connections acquired after the first one are new sessions, which
+	// would not hold the lock.
+	pool := &testConnPool{Conn: s.Db, dial: true}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, pool, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	c.Assert(pool.acquired, Equals, 1)
+	c.Assert(pool.released, Equals, 1)
+
+	var pid int
+	err = s.Db.QueryRow(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+	c.Assert(err, IsNil)
+	rows, err := s.Db.Query(ctx, "SELECT pid, locked FROM lock_checks")
+	c.Assert(err, IsNil)
+	checks, err := pgx.CollectRows(rows, pgx.RowToStructByPos[struct {
+		Pid    int
+		Locked bool
+	}])
+	c.Assert(err, IsNil)
+	c.Assert(checks, HasLen, 2)
+	for _, check := range checks {
+		c.Assert(check.Pid, Equals, pid)
+		c.Assert(check.Locked, Equals, true)
+	}
+
+	// The lock is released before the connection is returned.
+	var locked bool
+	err = s.Db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND pid = pg_backend_pid())").Scan(&locked)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, false)
+
+	s.Db.Exec(ctx, "DROP TABLE lock_checks")
+}
+
+func (s *SqliteMigrateSuite) TestAdvisoryLockWithPgxPool(c *C) {
+	heldLock := "INSERT INTO lock_checks SELECT pg_backend_pid(), EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted), current_setting('application_name')"
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE lock_checks (pid int, locked bool, application_name text)"}, Down: []string{"DROP TABLE lock_checks"}},
+			{Id: "2", Up: []string{heldLock}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{heldLock}, Down: []string{"SELECT 0"}},
+		},
+	}
+	ms := MigrationSet{UseAdvisoryLock: true, ApplicationName: "migrate-test"}
+
+	ctx := context.Background()
+	pool, err := pgxPoolConnect(4)
+	c.Assert(err, IsNil)
+	defer pool.Close()
+	defer s.Db.Exec(ctx, "DROP TABLE IF EXISTS lock_checks")
+
+	n, err := ms.Exec(ctx, pool, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	// Both migrations ran on the connection holding the lock, with its
+	// session settings.
+	rows, err := s.Db.Query(ctx, "SELECT DISTINCT pid, locked, application_name FROM lock_checks")
+	c.Assert(err, IsNil)
+	checks, err := pgx.CollectRows(rows, pgx.RowToStructByPos[struct {
+		Pid             int
+		Locked          bool
+		ApplicationName string
+	}])
+	c.Assert(err, IsNil)
+	c.Assert(checks, HasLen, 1)
+	c.Assert(checks[0].Locked, Equals, true)
+	c.Assert(checks[0].ApplicationName, Equals, "migrate-test")
+
+	// The lock is released before the connection is returned to the pool,
+	// and its settings restored.
+	var locked bool
+	err = s.Db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND pid = $1)", checks[0].Pid).Scan(&locked)
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, false)
+	var applicationName string
+	err = s.Db.QueryRow(ctx, "SELECT application_name FROM pg_stat_activity WHERE pid = $1", checks[0].Pid).Scan(&applicationName)
+	c.Assert(err, IsNil)
+	c.Assert(applicationName, Not(Equals), "migrate-test")
+
+	// Later executions are not blocked.
+	timeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	n, err = ms.Exec(timeout, pool, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *SqliteMigrateSuite) TestExecMultiSchema(c *C) {
+	ctx := context.Background()
+	schemas := []string{"tenant_a", "tenant_b", "tenant_c"}
+	for _, schema := range schemas {
+		_, err := s.Db.Exec(ctx, "CREATE SCHEMA "+schema)
+		c.Assert(err, IsNil)
+		defer s.Db.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+	}
+	// The migration fails on tenant_b.
+	_, err := s.Db.Exec(ctx, "CREATE TABLE tenant_b.people (id int)")
+	c.Assert(err, IsNil)
+
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations[:1],
+	}
+	results, err := ExecMultiSchema(ctx, s.Db, migrations, Up, schemas, false)
+	c.Assert(err, ErrorMatches, "schema tenant_b: .*")
+	c.Assert(results, HasLen, 2)
+	c.Assert(results[0], DeepEquals, SchemaResult{Schema: "tenant_a", Applied: 1})
+	c.Assert(results[1].Err, NotNil)
+
+	results, err = ExecMultiSchema(ctx, s.Db, migrations, Up, schemas, true)
+	c.Assert(err, ErrorMatches, "schema tenant_b: .*")
+	c.Assert(results, HasLen, 3)
+	c.Assert(results[0].Applied, Equals, 0)
+	c.Assert(results[1].Err, NotNil)
+	c.Assert(results[2], DeepEquals, SchemaResult{Schema: "tenant_c", Applied: 1})
+
+	// Migrations ran in each schema, which has its own migration table.
+	_, err = s.Db.Exec(ctx, "SELECT id FROM tenant_c.people")
+	c.Assert(err, IsNil)
+	versions, _, err := SchemaVersions(ctx, s.Db, schemas)
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, map[string]string{"tenant_a": "123", "tenant_b": "", "tenant_c": "123"})
+
+	// The search_path of the connection is restored.
+	_, err = s.Db.Exec(ctx, "SELECT id FROM people")
+	c.Assert(err, NotNil)
+}
+
+func (s *SqliteMigrateSuite) TestExecMultiSchemaSearchPath(c *C) {
+	ctx := context.Background()
+	_, err := s.Db.Exec(ctx, "CREATE SCHEMA tenant_a")
+	c.Assert(err, IsNil)
+	defer s.Db.Exec(ctx, "DROP SCHEMA tenant_a CASCADE")
+	_, err = s.Db.Exec(ctx, "CREATE FUNCTION public.next_person_id() RETURNS int AS 'SELECT 1' LANGUAGE SQL")
+	c.Assert(err, IsNil)
+	defer s.Db.Exec(ctx, "DROP FUNCTION public.next_person_id()")
+
+	// Functions of the previous search_path, such as the ones of extensions
+	// installed in public, still resolve.
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int DEFAULT next_person_id())", "INSERT INTO people DEFAULT VALUES"}, Down: []string{"DROP TABLE people"}},
+		},
+	}
+	results, err := ExecMultiSchema(ctx, s.Db, migrations, Up, []string{"tenant_a"}, false)
+	c.Assert(err, IsNil)
+	c.Assert(results, DeepEquals, []SchemaResult{{Schema: "tenant_a", Applied: 1}})
+
+	var id int
+	err = s.Db.QueryRow(ctx, "SELECT id FROM tenant_a.people").Scan(&id)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, 1)
+}
+
+func (s *SqliteMigrateSuite) TestSchemaVersions(c *C) {
+	ctx := context.Background()
+	for _, schema := range []string{"tenant_a", "tenant_b", "tenant_c"} {
+		_, err := s.Db.Exec(ctx, "CREATE SCHEMA "+schema)
+		c.Assert(err, IsNil)
+		defer s.Db.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+	}
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "2_a", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "10_b", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+	_, err := MigrationSet{SchemaName: "tenant_a"}.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	_, err = MigrationSet{SchemaName: "tenant_b"}.ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+
+	versions, missing, err := SchemaVersions(ctx, s.Db, []string{"tenant_a", "tenant_b", "tenant_c", "tenant_d"})
+	c.Assert(err, IsNil)
+	c.Assert(versions, DeepEquals, map[string]string{"tenant_a": "10_b", "tenant_b": "2_a"})
+	c.Assert(missing, DeepEquals, []string{"tenant_c", "tenant_d"})
+
+	// Interrupted migrations fail their schema, like CurrentVersion.
+	_, err = s.Db.Exec(ctx, fmt.Sprintf("UPDATE tenant_b.%s SET dirty = true", DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+	versions, _, err = SchemaVersions(ctx, s.Db, []string{"tenant_a", "tenant_b"})
+	c.Assert(err, ErrorMatches, "schema tenant_b: migrations interrupted .*")
+	var dirtyErr *DirtyError
+	c.Assert(errors.As(err, &dirtyErr), Equals, true)
+	c.Assert(dirtyErr.Ids, DeepEquals, []string{"2_a"})
+	c.Assert(versions, DeepEquals, map[string]string{"tenant_a": "10_b"})
+}
+
+func (s *SqliteMigrateSuite) TestLockKey(c *C) {
+	ctx := context.Background()
+	_, err := s.Db.Exec(ctx, "CREATE SCHEMA tenant_a")
+	c.Assert(err, IsNil)
+	defer s.Db.Exec(ctx, "DROP SCHEMA tenant_a CASCADE")
+
+	// Default keys are per migration table.
+	c.Assert(MigrationSet{SchemaName: "tenant_a"}.lockKey(), Not(Equals), MigrationSet{SchemaName: "tenant_b"}.lockKey())
+
+	serialize := func(schema, table string) int64 { return 42 }
+	ms := MigrationSet{SchemaName: "tenant_a", UseAdvisoryLock: true, LockKey: serialize}
+	c.Assert(ms.lockKey(), Equals, int64(42))
+
+	// Another tenant holds the shared lock.
+	holder, err := pgxConnect()
+	c.Assert(err, IsNil)
+	defer holder.Close(ctx)
+	_, err = holder.Exec(ctx, "SELECT pg_advisory_lock(42)")
+	c.Assert(err, IsNil)
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE tenant_a.people (id int)"}, Down: []string{"DROP TABLE tenant_a.people"}},
+		},
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = ms.Exec(timeoutCtx, s.Db, migrations, Up)
+	c.Assert(err, FitsTypeOf, &LockTimeoutError{})
+
+	_, err = holder.Exec(ctx, "SELECT pg_advisory_unlock(42)")
+	c.Assert(err, IsNil)
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// The migration table is in the schema.
+	var count int
+	err = s.Db.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(*) FROM tenant_a.%s", DefaultMigrationTableName)).Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *SqliteMigrateSuite) TestStatementsRunVerbatim(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id: "1",
+				Up: []string{
+					"CREATE TABLE people (name text)",
+					"INSERT INTO people (name) VALUES ('first; second')",
+					`DO $$ BEGIN INSERT INTO people (name) VALUES ('third;'); END $$`,
+				},
+				Down: []string{"DROP TABLE people"},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	rows, err := s.Db.Query(ctx, "SELECT name FROM people ORDER BY name")
+	c.Assert(err, IsNil)
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"first; second", "third;"})
+}
+
+func (s *SqliteMigrateSuite) TestExecMaxResult(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+
+	ctx := context.Background()
+	result, err := ExecMaxResult(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+	c.Assert(result.MoreAvailable, Equals, true)
+
+	result, err = ExecMaxResult(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+	c.Assert(result.MoreAvailable, Equals, false)
+
+	result, err = ExecMaxResult(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 0)
+	c.Assert(result.MoreAvailable, Equals, false)
+}
+
+func (s *SqliteMigrateSuite) TestSkippedMigrations(c *C) {
+	source := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "3_seed", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "4", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+	migrations := FilterMigrationSource(source, func(m *Migration) bool {
+		return !strings.HasSuffix(m.Id, "_seed")
+	})
+
+	ctx := context.Background()
+	_, err := ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+
+	result, err := ExecMaxResult(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+	c.Assert(result.MoreAvailable, Equals, true)
+	reasons := make(map[string]SkipReason)
+	for _, skipped := range result.Skipped {
+		reasons[skipped.Migration.Id] = skipped.Reason
+	}
+	c.Assert(reasons, DeepEquals, map[string]SkipReason{
+		"1":      SkippedAlreadyApplied,
+		"3_seed": SkippedByFilter,
+		"4":      SkippedByLimit,
+	})
+
+	result, err = ExecMaxResult(ctx, s.Db, migrations, Down, 1)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+	reasons = make(map[string]SkipReason)
+	for _, skipped := range result.Skipped {
+		reasons[skipped.Migration.Id] = skipped.Reason
+	}
+	c.Assert(reasons, DeepEquals, map[string]SkipReason{
+		"1":      SkippedByLimit,
+		"3_seed": SkippedByFilter,
+		"4":      SkippedNotApplied,
+	})
+}
+
+func (s *SqliteMigrateSuite) TestExplainBeforeApply(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"INSERT INTO people (id) SELECT generate_series(1, 100)", "update people SET id = id + 1"}, Down: []string{"DELETE FROM people"}},
+		},
+	}
+	logger := &recordingLogger{}
+	ms := MigrationSet{ExplainBeforeApply: true, Logger: logger}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	// DDL is not explained.
+	c.Assert(logger.messages, HasLen, 2)
+	c.Assert(logger.messages[0], Matches, `run [0-9a-f-]{36}: statement 0 of migration 2 is estimated as: Insert on people .*cost=.* rows=.*`)
+	c.Assert(logger.messages[1], Matches, `run [0-9a-f-]{36}: statement 1 of migration 2 is estimated as: Update on people .*cost=.* rows=.*`)
+
+	var count int
+	err = s.Db.QueryRow(ctx, "SELECT count(*) FROM people").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 100)
+}
+
+func (s *SqliteMigrateSuite) TestExplainContinueOnError(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{
+				Id: "1",
+				Up: []string{
+					"CREATE TABLE people (id int, CHECK (fail))",
+					"INSERT INTO people (id) VALUES (1)",
+					"CREATE TABLE pets (id int)",
+				},
+				Down:            []string{"DROP TABLE IF EXISTS pets"},
+				ContinueOnError: true,
+			},
+		},
+	}
+	ms := MigrationSet{ExplainBeforeApply: true, Logger: &recordingLogger{}}
+
+	// The EXPLAIN of the INSERT fails like the statement would, and only
+	// skips it.
+	ctx := context.Background()
+	result, err := ms.ExecMaxResult(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+	c.Assert(result.Warnings, HasLen, 2)
+	c.Assert(result.Warnings[1].(*StatementError).Index, Equals, 1)
+
+	_, err = s.Db.Exec(ctx, "SELECT id FROM pets")
+	c.Assert(err, IsNil)
+
+	// Tear down
+	s.Db.Exec(ctx, "DROP TABLE IF EXISTS pets")
+}
+
+func (s *SqliteMigrateSuite) TestEnvSubstitution(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (name text)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"INSERT INTO people (name) VALUES ('${PERSON_NAME}')"}, Down: []string{"DELETE FROM people"}},
+		},
+	}
+	env := map[string]string{}
+	ms := MigrationSet{
+		EnableEnvSubstitution: true,
+		LookupEnv: func(name string) (string, bool) {
+			value, ok := env[name]
+			return value, ok
+		},
+	}
+
+	// Nothing is applied when a variable is unset.
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(n, Equals, 0)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "2")
+
+	env["PERSON_NAME"] = "alice"
+	n, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	var name string
+	err = s.Db.QueryRow(ctx, "SELECT name FROM people").Scan(&name)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "alice")
+}
+
+func (s *SqliteMigrateSuite) TestMissingDown(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	n, err := Exec(ctx, s.Db, migrations, Down)
+	c.Assert(n, Equals, 0)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "2")
+
+	ms := MigrationSet{AllowMissingDown: true}
+	n, err = ms.Exec(ctx, s.Db, migrations, Down)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *SqliteMigrateSuite) TestAtomicDown(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT fail"}},
+			{Id: "3", Up: []string{"CREATE TABLE pets (id int)"}, Down: []string{"DROP TABLE pets"}},
+		},
+	}
+	ms := MigrationSet{AtomicDown: true}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	// Reverting 2 fails, so 3 is restored.
+	n, err = ms.Exec(ctx, s.Db, migrations, Down)
+	c.Assert(err, NotNil)
+	c.Assert(n, Equals, 0)
+
+	records, err := ms.GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	_, err = s.Db.Exec(ctx, "SELECT * FROM pets")
+	c.Assert(err, IsNil)
+
+	migrations.Migrations[1].Down = []string{"SELECT 0"}
+	n, err = ms.Exec(ctx, s.Db, migrations, Down)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	records, err = ms.GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+}
+
+func (s *SqliteMigrateSuite) TestAtomicDownNoTransaction(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}, DisableTransactionDown: true},
+		},
+	}
+	ms := MigrationSet{AtomicDown: true}
+
+	ctx := context.Background()
+	_, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	n, err := ms.Exec(ctx, s.Db, migrations, Down)
+	c.Assert(n, Equals, 0)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+}
+
+func (s *SqliteMigrateSuite) TestAfterAll(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+		},
+	}
+	ms := MigrationSet{
+		AfterAll: []string{"ANALYZE people", "INSERT INTO people (id) VALUES (1)"},
+	}
+
+	ctx := context.Background()
+	n, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Not run when nothing was applied.
+	n, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	var count int
+	err = s.Db.QueryRow(ctx, "SELECT COUNT(*) FROM people").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 1)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+}
+
+func (s *SqliteMigrateSuite) TestByteOrderMark(c *C) {
+	migrations := &HttpFileSystemMigrationSource{
+		FileSystem: http.FS(fstest.MapFS{
+			"1_initial.sql": {Data: []byte("\uFEFF-- +migrate Up\nCREATE TABLE people (id int);\n\n-- +migrate Down\nDROP TABLE people;\n")},
+		}),
+	}
+
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	_, err = s.Db.Exec(ctx, "SELECT * FROM people")
+	c.Assert(err, IsNil)
+}
+
+func (s *SqliteMigrateSuite) TestExecWithPlan(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+
+	ctx := context.Background()
+	applied, err := ExecWithPlan(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(applied, HasLen, 2)
+	c.Assert(applied[0].Id, Equals, "123")
+	c.Assert(applied[0].Queries, DeepEquals, testMigrations[0].Up)
+	c.Assert(applied[1].Id, Equals, "124")
+
+	applied, err = ExecWithPlan(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(applied, HasLen, 0)
+
+	// Only applied migrations are returned.
+	migrations.Migrations = append(migrations.Migrations[:2:2], &Migration{Id: "125", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}}, &Migration{Id: "126", Up: []string{"SELECT invalid"}, Down: []string{"SELECT 0"}})
+	applied, err = ExecWithPlan(ctx, s.Db, migrations, Up)
+	c.Assert(err, NotNil)
+	c.Assert(applied, HasLen, 1)
+	c.Assert(applied[0].Id, Equals, "125")
+}
+
+func (s *SqliteMigrateSuite) TestKeepRevertedRecords(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+	ms := MigrationSet{KeepRevertedRecords: true}
+
+	ctx := context.Background()
+	_, err := ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	n, err := ms.ExecMax(ctx, s.Db, migrations, Down, 1)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// The reverted migration is no longer applied, but its record is kept.
+	records, err := ms.GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Id, Equals, "123")
+
+	version, err := ms.CurrentVersion(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, "123")
+
+	var reverted int
+	err = s.Db.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE reverted_at IS NOT NULL", DefaultMigrationTableName)).Scan(&reverted)
+	c.Assert(err, IsNil)
+	c.Assert(reverted, Equals, 1)
+
+	// Applying it again revives the record.
+	n, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	records, err = ms.GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[1].Id, Equals, "124")
+}
+
+func (s *SqliteMigrateSuite) TestDescribeUnknownMigrations(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "3", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	unknown, err := DescribeUnknownMigrations(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(unknown, HasLen, 0)
+
+	unknown, err = DescribeUnknownMigrations(ctx, s.Db, &MemoryMigrationSource{Migrations: migrations.Migrations[1:2]})
+	c.Assert(err, IsNil)
+	c.Assert(unknown, HasLen, 2)
+	c.Assert(unknown[0].Id, Equals, "1")
+	c.Assert(unknown[1].Id, Equals, "3")
+}
+
+func (s *SqliteMigrateSuite) TestAppliedSQL(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 1"}, Down: []string{"SELECT -1"}},
+			{Id: "2", Up: []string{"SELECT 2"}, Down: []string{"SELECT -2"}},
+			{Id: "3", Up: []string{"SELECT 3", "SELECT 33"}, Down: []string{"SELECT -3"}},
+			{Id: "4", Up: []string{"SELECT 4"}, Down: []string{"SELECT -4"}},
+		},
+	}
+
+	// Applied out of order, and 4 not at all.
+	ctx := context.Background()
+	for _, id := range []string{"1", "3", "2"} {
+		_, err := ExecExplicit(ctx, s.Db, migrations, Up, []string{id})
+		c.Assert(err, IsNil)
+	}
+
+	statements, err := AppliedSQL(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(statements, DeepEquals, []string{"SELECT 1", "SELECT 3", "SELECT 33", "SELECT 2"})
+
+	statements, err = AppliedSQL(ctx, s.Db, migrations, Down)
+	c.Assert(err, IsNil)
+	c.Assert(statements, DeepEquals, []string{"SELECT -2", "SELECT -3", "SELECT -1"})
+
+	_, err = AppliedSQL(ctx, s.Db, &MemoryMigrationSource{Migrations: migrations.Migrations[:2]}, Up)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+}
+
+func (s *SqliteMigrateSuite) TestApplicationName(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (name text)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"INSERT INTO people (name) SELECT current_setting('application_name')"}, Down: []string{"DELETE FROM people"}},
+		},
+	}
+
+	ctx := context.Background()
+	var previous string
+	err := s.Db.QueryRow(ctx, "SELECT current_setting('application_name')").Scan(&previous)
+	c.Assert(err, IsNil)
+
+	ms := MigrationSet{ApplicationName: "sql-migrate"}
+	_, err = ms.Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	var name string
+	err = s.Db.QueryRow(ctx, "SELECT name FROM people").Scan(&name)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "sql-migrate")
+
+	// Restored after the execution.
+	err = s.Db.QueryRow(ctx, "SELECT current_setting('application_name')").Scan(&name)
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, previous)
+}
+
+func (s *SqliteMigrateSuite) TestWaitForDB(c *C) {
+	ctx := context.Background()
+	err := WaitForDB(ctx, s.Db, 10*time.Millisecond)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	ms := MigrationSet{PingQuery: "SELECT 1 FROM not_ready"}
+	err = ms.WaitForDB(ctx, s.Db, 10*time.Millisecond)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+}
+
+func (s *SqliteMigrateSuite) TestNoTransaction(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{
+				Id:                     "2",
+				Up:                     []string{"CREATE INDEX CONCURRENTLY people_id_idx ON people (id)"},
+				Down:                   []string{"DROP INDEX CONCURRENTLY people_id_idx"},
+				DisableTransactionUp:   true,
+				DisableTransactionDown: true,
+			},
+		},
+	}
+
+	// CREATE INDEX CONCURRENTLY fails within a transaction.
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	n, err = ExecMax(ctx, s.Db, migrations, Down, 1)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+}
+
+func (s *SqliteMigrateSuite) TestDirtyNoTransaction(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{
+				Id:                   "2",
+				Up:                   []string{"CREATE INDEX CONCURRENTLY people_id_idx ON people (id)", "SELECT fail"},
+				Down:                 []string{"DROP INDEX people_id_idx"},
+				DisableTransactionUp: true,
+			},
+		},
+	}
+
+	ctx := context.Background()
+	n, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, NotNil)
+	c.Assert(n, Equals, 1)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].Dirty, Equals, false)
+	c.Assert(records[1].Dirty, Equals, true)
+
+	// The interrupted migration is not run again.
+	n, err = Exec(ctx, s.Db, migrations, Up)
+	c.Assert(n, Equals, 0)
+	c.Assert(err, FitsTypeOf, &DirtyError{})
+	c.Assert(err.(*DirtyError).Ids, DeepEquals, []string{"2"})
+
+	// Nor is it read as applied or pending.
+	_, err = PlanMigration(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, FitsTypeOf, &DirtyError{})
+	_, err = CurrentVersion(ctx, s.Db)
+	c.Assert(err, FitsTypeOf, &DirtyError{})
+	_, err = PendingCount(ctx, s.Db, migrations)
+	c.Assert(err, FitsTypeOf, &DirtyError{})
+	records, err = GetMigrationRecordsById(ctx, s.Db)
+	c.Assert(err, FitsTypeOf, &DirtyError{})
+	c.Assert(records, HasLen, 2)
+
+	// Once repaired, executions resume.
+	_, err = s.Db.Exec(ctx, fmt.Sprintf("UPDATE %s SET dirty = false WHERE id = '2'", DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+	n, err = Exec(ctx, s.Db, migrations, Down)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *SqliteMigrateSuite) TestRecordsTimeout(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := Exec(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	// Block the record of the next migration with an uncommitted one.
+	blocker, err := pgxConnect()
+	c.Assert(err, IsNil)
+	defer blocker.Close(ctx)
+	tx, err := blocker.Begin(ctx)
+	c.Assert(err, IsNil)
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (id) VALUES ('2')", DefaultMigrationTableName))
+	c.Assert(err, IsNil)
+
+	// The migration statement outlasts the timeout, only bookkeeping is bounded.
+	migrations.Migrations = append(migrations.Migrations, &Migration{Id: "2", Up: []string{"SELECT pg_sleep(0.5)"}, Down: []string{"SELECT 0"}})
+	migrator, err := pgxConnect()
+	c.Assert(err, IsNil)
+	defer migrator.Close(ctx)
+
+	ms := MigrationSet{RecordsTimeout: 200 * time.Millisecond}
+	start := time.Now()
+	n, err := ms.Exec(ctx, migrator, migrations, Up)
+	c.Assert(n, Equals, 0)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (s *SqliteMigrateSuite) TestExecStrict(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+		},
+	}
+
+	ctx := context.Background()
+	result, err := ExecStrict(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+
+	// Changing an applied migration is refused.
+	migrations.Migrations = []*Migration{
+		{Id: "1", Up: []string{"CREATE TABLE people (id bigint)"}, Down: []string{"DROP TABLE people"}},
+		{Id: "2", Up: []string{"ALTER TABLE people ADD COLUMN first_name text"}, Down: []string{"SELECT 0"}},
+	}
+	result, err = ExecStrict(ctx, s.Db, migrations)
+	c.Assert(err, FitsTypeOf, &DriftError{})
+	c.Assert(err.(*DriftError).Migrations[0].Id, Equals, "1")
+	c.Assert(result.Applied, Equals, 0)
+	c.Assert(err.(*DriftError).Grown, HasLen, 0)
+
+	// Statements added to an applied migration are told apart.
+	grown := &Migration{Id: "1", Up: []string{"CREATE TABLE people (id int)", "CREATE INDEX people_id_idx ON people (id)"}, Down: []string{"DROP TABLE people"}}
+	_, err = ExecStrict(ctx, s.Db, &MemoryMigrationSource{Migrations: []*Migration{grown}})
+	c.Assert(err, FitsTypeOf, &DriftError{})
+	c.Assert(err.(*DriftError).Grown, DeepEquals, []*Migration{grown})
+
+	// Unknown migrations are refused even when ignored globally.
+	SetIgnoreUnknown(true)
+	defer SetIgnoreUnknown(false)
+	result, err = ExecStrict(ctx, s.Db, &MemoryMigrationSource{Migrations: migrations.Migrations[1:]})
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(result.Applied, Equals, 0)
+
+	migrations.Migrations[0].Up = []string{"CREATE TABLE people (id int)"}
+	result, err = ExecStrict(ctx, s.Db, migrations)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+}
+
+// recordingTracer keeps the SQL and arguments of every query issued on a
+// connection.
+type recordingTracer struct {
+	queries []string
+	args    [][]any
+}
+
+func (t *recordingTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	t.queries = append(t.queries, data.SQL)
+	t.args = append(t.args, data.Args)
+	return ctx
+}
+
+func (t *recordingTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+func (s *SqliteMigrateSuite) TestQueriesUseCallerConnection(c *C) {
+	tracer := &recordingTracer{}
+	db, err := pgxConnectWithTracer(tracer)
+	c.Assert(err, IsNil)
+	defer db.Close(context.Background())
+
+	ctx := context.Background()
+	n, err := Exec(ctx, db, &MemoryMigrationSource{Migrations: testMigrations[:1]}, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Bookkeeping queries go through the caller's connection and its tracer.
+	traced := strings.Join(tracer.queries, "\n")
+	c.Assert(strings.Contains(traced, "CREATE TABLE IF NOT EXISTS"), Equals, true)
+	c.Assert(strings.Contains(traced, testMigrations[0].Up[0]), Equals, true)
+	c.Assert(strings.Contains(traced, "INSERT INTO"), Equals, true)
+}
+
+func (s *SqliteMigrateSuite) TestStatementsUseSimpleProtocol(c *C) {
+	tracer := &recordingTracer{}
+	db, err := pgxConnectWithTracer(tracer)
+	c.Assert(err, IsNil)
+	defer db.Close(context.Background())
+
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"ALTER TABLE people ADD name text"}, Down: []string{"ALTER TABLE people DROP name"}, DisableTransactionUp: true},
+		},
+	}
+	ctx := context.Background()
+	n, err := Exec(ctx, db, migrations, Up)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	statements := 0
+	for i, sql := range tracer.queries {
+		if sql == migrations.Migrations[0].Up[0] || sql == migrations.Migrations[1].Up[0] {
+			statements++
+			c.Assert(tracer.args[i], DeepEquals, []any{pgx.QueryExecModeSimpleProtocol})
+		}
+	}
+	c.Assert(statements, Equals, 2)
+}
+
+func (s *SqliteMigrateSuite) TestContinueOnError(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{
+				Id:              "2",
+				Up:              []string{"INSERT INTO people (id) VALUES (1)", "INSERT INTO missing (id) VALUES (1)", "INSERT INTO people (id) VALUES (2)"},
+				Down:            []string{"DELETE FROM people"},
+				ContinueOnError: true,
+			},
+		},
+	}
+	logger := &recordingLogger{}
+	ms := MigrationSet{Logger: logger}
+
+	ctx := context.Background()
+	results, err := ms.ExecStream(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	var last MigrationResult
+	for result := range results {
+		c.Assert(result.Err, IsNil)
+		last = result
+	}
+	c.Assert(last.Migration.Id, Equals, "2")
+	c.Assert(last.Warnings, HasLen, 1)
+	c.Assert(last.Warnings[0], FitsTypeOf, &StatementError{})
+	c.Assert(last.Warnings[0].(*StatementError).Index, Equals, 1)
+	c.Assert(logger.messages, HasLen, 1)
+
+	// The statements around the failed one were applied, and so was the
+	// migration.
+	var count int
+	err = s.Db.QueryRow(ctx, "SELECT count(*) FROM people").Scan(&count)
+	c.Assert(err, IsNil)
+	c.Assert(count, Equals, 2)
+
+	records, err := GetMigrationRecords(ctx, s.Db)
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+
+	// Executions returning a result report the warnings too.
+	_, err = ms.ExecMax(ctx, s.Db, migrations, Down, 1)
+	c.Assert(err, IsNil)
+	result, err := ms.ExecMaxResult(ctx, s.Db, migrations, Up, 0)
+	c.Assert(err, IsNil)
+	c.Assert(result.Applied, Equals, 1)
+	c.Assert(result.Warnings, HasLen, 1)
+	c.Assert(result.Warnings[0].(*StatementError).Index, Equals, 1)
+}
+
+func (s *SqliteMigrateSuite) TestExecStream(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			testMigrations[0],
+			testMigrations[1],
+			{
+				Id:   "125",
+				Up:   []string{"SELECT fail"},
+				Down: []string{"SELECT 0"},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	results, err := ExecStream(ctx, s.Db, migrations, Up)
+	c.Assert(err, IsNil)
+
+	var ids []string
+	var errs []error
+	for result := range results {
+		ids = append(ids, result.Migration.Id)
+		errs = append(errs, result.Err)
+	}
+	c.Assert(ids, DeepEquals, []string{"123", "124", "125"})
+	c.Assert(errs[0], IsNil)
+	c.Assert(errs[1], IsNil)
+	c.Assert(errs[2], NotNil)
+
+	// Planning errors are returned directly.
+	_, err = ExecStream(ctx, s.Db, &MemoryMigrationSource{Migrations: testMigrations[1:]}, Up)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+
+	// Failures outside of a migration end the stream.
+	ms := MigrationSet{AfterAll: []string{"SELECT fail"}}
+	results, err = ms.ExecStream(ctx, s.Db, &MemoryMigrationSource{Migrations: testMigrations}, Down)
+	c.Assert(err, IsNil)
+	var all []MigrationResult
+	for result := range results {
+		all = append(all, result)
+	}
+	c.Assert(all, HasLen, 3)
+	c.Assert(all[0].Err, IsNil)
+	c.Assert(all[1].Err, IsNil)
+	c.Assert(all[2].Migration, IsNil)
+	c.Assert(all[2].Err, ErrorMatches, `.*column "fail" does not exist.*`)
+}
+
+func (s *SqliteMigrateSuite) TestExecExplicit(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "0040", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "0041", Up: []string{"ALTER TABLE people ADD COLUMN first_name text"}, Down: []string{"ALTER TABLE people DROP COLUMN first_name"}},
+			{Id: "0042", Up: []string{"ALTER TABLE people ADD COLUMN last_name text"}, Down: []string{"ALTER TABLE people DROP COLUMN last_name"}},
+		},
+	}
+
+	ctx := context.Background()
+	n, err := ExecMax(ctx, s.Db, migrations, Up, 1)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	_, err = ExecExplicit(ctx, s.Db, migrations, Up, []string{"0043"})
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	_, err = ExecExplicit(ctx, s.Db, migrations, Up, []string{"0040"})
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	_, err = ExecExplicit(ctx, s.Db, migrations, Down, []string{"0042"})
+	c.Assert(err, FitsTypeOf, &PlanError{})
+
+	// Skips over 0041
+	n, err = ExecExplicit(ctx, s.Db, migrations, Up, []string{"0042"})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	_, err = s.Db.Exec(ctx, "SELECT last_name FROM people")
+	c.Assert(err, IsNil)
+	_, err = s.Db.Exec(ctx, "SELECT first_name FROM people")
+	c.Assert(err, NotNil)
+
+	n, err = ExecExplicit(ctx, s.Db, migrations, Down, []string{"0042"})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
@@ -0,0 +1,296 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type PlanSuite struct{}
+
+var _ = Suite(&PlanSuite{})
+
+// Returns n sorted migrations and the records of the first applied of them,
+// leaving a hole every hole migrations.
+func syntheticMigrations(n, applied, hole int) ([]*Migration, []*MigrationRecord) {
+	migrations := make([]*Migration, 0, n)
+	records := make([]*MigrationRecord, 0, applied)
+	for i := 1; i <= n; i++ {
+		migration := &Migration{
+			Id:   fmt.Sprintf("%d_migration.sql", i),
+			Up:   []string{"SELECT 0"},
+			Down: []string{"SELECT 0"},
+		}
+		migrations = append(migrations, migration)
+		if i <= applied && i%hole != 0 {
+			records = append(records, &MigrationRecord{Id: migration.Id})
+		}
+	}
+	return migrations, records
+}
+
+func (s *PlanSuite) TestPlanMigrations(c *C) {
+	migrations, records := syntheticMigrations(10, 6, 4)
+
+	planned, err := MigrationSet{}.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, IsNil)
+	var ids []string
+	for _, migration := range planned {
+		ids = append(ids, migration.Id)
+	}
+	c.Assert(ids, DeepEquals, []string{"4_migration.sql", "7_migration.sql", "8_migration.sql", "9_migration.sql", "10_migration.sql"})
+
+	planned, err = MigrationSet{}.planMigrations(migrations, records, Down, 2, -1)
+	c.Assert(err, IsNil)
+	c.Assert(planned, HasLen, 3)
+	c.Assert(planned[0].Id, Equals, "4_migration.sql")
+	c.Assert(planned[0].catchup, Equals, true)
+	c.Assert(planned[1].Id, Equals, "6_migration.sql")
+	c.Assert(planned[2].Id, Equals, "5_migration.sql")
+
+	_, err = MigrationSet{}.planMigrations(migrations[1:], records, Up, 0, -1)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+}
+
+func (s *PlanSuite) TestDefaultMigrationSet(c *C) {
+	migrations, records := syntheticMigrations(4, 2, 10)
+	records = append(records, &MigrationRecord{Id: "1_removed.sql"})
+
+	ms := DefaultMigrationSet()
+	ms.IgnoreUnknown = true
+	_, err := ms.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, IsNil)
+
+	// The package defaults are left untouched.
+	c.Assert(DefaultMigrationSet().IgnoreUnknown, Equals, false)
+	_, err = DefaultMigrationSet().planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+}
+
+func (s *PlanSuite) TestDisableFillHoles(c *C) {
+	migrations, records := syntheticMigrations(10, 6, 4)
+
+	// Holes are filled by default.
+	planned, err := MigrationSet{}.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(planned[0].Id, Equals, "4_migration.sql")
+	c.Assert(planned[0].catchup, Equals, true)
+
+	ms := MigrationSet{DisableFillHoles: true}
+	_, err = ms.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err, ErrorMatches, ".*unapplied migration below the last applied one 6_migration.sql .*")
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "4_migration.sql")
+
+	// Without holes, planning is unchanged.
+	migrations, records = syntheticMigrations(10, 6, 10)
+	planned, err = ms.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(planned, HasLen, 4)
+}
+
+func (s *PlanSuite) TestOnUnknownMigration(c *C) {
+	migrations, records := syntheticMigrations(4, 2, 10)
+	records = append(records,
+		&MigrationRecord{Id: "1_hotfix.sql"},
+		&MigrationRecord{Id: "1_removed.sql"},
+	)
+
+	var seen []string
+	ms := MigrationSet{
+		OnUnknownMigration: func(record MigrationRecord) (bool, error) {
+			seen = append(seen, record.Id)
+			return record.Id == "1_hotfix.sql", nil
+		},
+	}
+	_, err := ms.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "1_removed.sql")
+	c.Assert(seen, DeepEquals, []string{"1_hotfix.sql", "1_removed.sql"})
+
+	ms.OnUnknownMigration = func(record MigrationRecord) (bool, error) {
+		return true, nil
+	}
+	planned, err := ms.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(planned, HasLen, 2)
+
+	abort := errors.New("unknown migrations need review")
+	ms.OnUnknownMigration = func(record MigrationRecord) (bool, error) {
+		return false, abort
+	}
+	_, err = ms.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, Equals, abort)
+}
+
+func (s *PlanSuite) TestReplaces(c *C) {
+	migrations, records := syntheticMigrations(3, 3, 10)
+	baseline := &Migration{Id: "3_migration.sql_baseline", Up: []string{"SELECT 0"}}
+
+	// The records of the replaced migrations are unknown without Replaces.
+	_, err := MigrationSet{}.planMigrations([]*Migration{baseline}, records, Up, 0, -1)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+
+	// Databases which applied them have the baseline applied.
+	for _, migration := range migrations {
+		baseline.Replaces = append(baseline.Replaces, migration.Id)
+	}
+	next := &Migration{Id: "4_migration.sql", Up: []string{"SELECT 0"}}
+	ms := MigrationSet{RefuseDowngrade: true}
+	planned, err := ms.planMigrations([]*Migration{baseline, next}, records, Up, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(planned, HasLen, 1)
+	c.Assert(planned[0].Id, Equals, next.Id)
+
+	// New databases apply it.
+	planned, err = ms.planMigrations([]*Migration{baseline, next}, nil, Up, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(planned, HasLen, 2)
+	c.Assert(planned[0].Id, Equals, baseline.Id)
+
+	_, err = ms.planMigrations([]*Migration{baseline, next}, records[:2], Up, 0, -1)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err, ErrorMatches, ".*only some of the migrations it replaces are applied")
+}
+
+func (s *PlanSuite) TestUpOnly(c *C) {
+	ctx := context.Background()
+	db := &fakeQueryer{}
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+	ms := MigrationSet{AllowedDirections: UpOnly}
+
+	n, err := ms.Exec(ctx, db, migrations, Down)
+	c.Assert(err, Equals, ErrDownDisabled)
+	c.Assert(n, Equals, 0)
+	_, err = ms.PlanMigration(ctx, db, migrations, Down, 0)
+	c.Assert(err, Equals, ErrDownDisabled)
+	_, err = ms.ExecStream(ctx, db, migrations, Down)
+	c.Assert(err, Equals, ErrDownDisabled)
+
+	// Nothing reached the database.
+	c.Assert(db.execs, HasLen, 0)
+}
+
+func (s *PlanSuite) TestTimeBudget(c *C) {
+	migrations, _ := syntheticMigrations(2, 0, 10)
+	planned := []*PlannedMigration{newPlannedMigration(migrations[0], Up), newPlannedMigration(migrations[1], Up)}
+	db := &fakeQueryer{}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	applied, err := MigrationSet{}.applyMigrations(ctx, db, nil, Up, planned)
+	c.Assert(errors.Is(err, ErrTimeBudgetExceeded), Equals, true)
+	c.Assert(err, ErrorMatches, ".* stopped before migration 1_migration.sql")
+	c.Assert(applied, HasLen, 0)
+
+	// Too little time is left to start a migration.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	_, err = MigrationSet{MinTimeLeft: 2 * time.Hour}.applyMigrations(ctx, db, nil, Up, planned)
+	c.Assert(errors.Is(err, ErrTimeBudgetExceeded), Equals, true)
+
+	// Nothing reached the database.
+	c.Assert(db.execs, HasLen, 0)
+}
+
+func (s *PlanSuite) TestResumePlan(c *C) {
+	migrations, records := syntheticMigrations(10, 6, 10)
+	planned, err := MigrationSet{}.planMigrations(migrations, records, Up, 0, -1)
+	c.Assert(err, IsNil)
+
+	resumed, err := resumePlan(migrations, planned, Up, "7_migration.sql")
+	c.Assert(err, IsNil)
+	c.Assert(resumed, HasLen, 4)
+	c.Assert(resumed[0].Id, Equals, "7_migration.sql")
+
+	_, err = resumePlan(migrations, planned, Up, "8_migration.sql")
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "7_migration.sql")
+
+	_, err = resumePlan(migrations, planned, Up, "11_migration.sql")
+	c.Assert(err, ErrorMatches, "unknown migration 11_migration.sql to resume from")
+
+	planned, err = MigrationSet{}.planMigrations(migrations, records, Down, 0, -1)
+	c.Assert(err, IsNil)
+	_, err = resumePlan(migrations, planned, Down, "3_migration.sql")
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "6_migration.sql")
+	resumed, err = resumePlan(migrations, planned, Down, "6_migration.sql")
+	c.Assert(err, IsNil)
+	c.Assert(resumed, HasLen, 6)
+}
+
+func (s *PlanSuite) TestApplyWithFakeQueryer(c *C) {
+	migrations := []*Migration{
+		{Id: "1", Up: []string{"CREATE TABLE a (id int)"}, Down: []string{"DROP TABLE a"}},
+		{Id: "2", Up: []string{"CREATE TABLE b (id int)"}, Down: []string{"DROP TABLE b"}},
+	}
+	planned := []*PlannedMigration{newPlannedMigration(migrations[0], Up), newPlannedMigration(migrations[1], Up)}
+	failure := errors.New("relation b already exists")
+	db := &fakeQueryer{execErrs: map[string]error{"CREATE TABLE b (id int)": failure}}
+
+	applied, err := MigrationSet{}.applyMigrations(context.Background(), db, nil, Up, planned)
+	c.Assert(err, FitsTypeOf, &StatementError{})
+	c.Assert(errors.Is(err, failure), Equals, true)
+	c.Assert(applied, HasLen, 1)
+	c.Assert(applied[0].Id, Equals, "1")
+
+	// The first migration was recorded and committed, the second rolled back.
+	c.Assert(db.execs, HasLen, 3)
+	c.Assert(db.execs[0], Equals, "CREATE TABLE a (id int)")
+	c.Assert(db.execs[1], Matches, "INSERT INTO .*")
+	c.Assert(db.execs[2], Equals, "CREATE TABLE b (id int)")
+	c.Assert(db.commits, Equals, 1)
+	c.Assert(db.rollbacks, Equals, 1)
+}
+
+func (s *PlanSuite) TestAtomicResults(c *C) {
+	migrations := []*Migration{
+		{Id: "1", Up: []string{"CREATE TABLE a (id int)"}, Down: []string{"DROP TABLE a"}},
+		{Id: "2", Up: []string{"CREATE TABLE b (id int)"}, Down: []string{"DROP TABLE b"}},
+	}
+	planned := []*PlannedMigration{newPlannedMigration(migrations[1], Down), newPlannedMigration(migrations[0], Down)}
+	failure := errors.New("table a is in use")
+	db := &fakeQueryer{execErrs: map[string]error{"DROP TABLE a": failure}}
+
+	// The revert of the first migration is rolled back with the second.
+	var results []MigrationResult
+	ms := MigrationSet{AtomicDown: true, onResult: func(result MigrationResult) {
+		results = append(results, result)
+	}}
+	_, err := ms.applyAtomically(context.Background(), db, Down, planned)
+	c.Assert(errors.Is(err, failure), Equals, true)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Migration.Id, Equals, "1")
+	c.Assert(errors.Is(results[0].Err, failure), Equals, true)
+
+	results = nil
+	applied, err := ms.applyAtomically(context.Background(), &fakeQueryer{}, Down, planned)
+	c.Assert(err, IsNil)
+	c.Assert(applied, HasLen, 2)
+	c.Assert(results, HasLen, 2)
+	c.Assert(results[0].Err, IsNil)
+	c.Assert(results[1].Err, IsNil)
+}
+
+func (s *PlanSuite) TestAppliedWarnings(c *C) {
+	warning := &StatementError{Index: 1, Err: errors.New("relation missing does not exist")}
+	applied := []*PlannedMigration{{warnings: []error{warning}}, {}, {warnings: []error{warning, warning}}}
+	c.Assert(appliedWarnings(applied), DeepEquals, []error{warning, warning, warning})
+	c.Assert(appliedWarnings(nil), IsNil)
+}
+
+func (s *PlanSuite) BenchmarkPlanMigrations(c *C) {
+	migrations, records := syntheticMigrations(5000, 4000, 100)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if _, err := (MigrationSet{}).planMigrations(migrations, records, Up, 0, -1); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
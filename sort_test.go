@@ -33,3 +33,21 @@ func (s *SortSuite) TestSortMigrations(c *C) {
 	c.Assert(migrations[6].Id, Equals, "120_cde")
 	c.Assert(migrations[7].Id, Equals, "efg")
 }
+
+func (s *SortSuite) TestIsOrdered(c *C) {
+	ordered, a, b := IsOrdered([]string{"1_abc", "2_cde", "10_abc", "120_cde", "efg"})
+	c.Assert(ordered, Equals, true)
+	c.Assert(a, Equals, "")
+	c.Assert(b, Equals, "")
+
+	ordered, a, b = IsOrdered([]string{"1_foo", "10_bar", "2_baz"})
+	c.Assert(ordered, Equals, false)
+	c.Assert(a, Equals, "10_bar")
+	c.Assert(b, Equals, "2_baz")
+
+	// Duplicates are not strictly increasing.
+	ordered, a, b = IsOrdered([]string{"1_foo", "1_foo"})
+	c.Assert(ordered, Equals, false)
+	c.Assert(a, Equals, "1_foo")
+	c.Assert(b, Equals, "1_foo")
+}
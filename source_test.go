@@ -0,0 +1,705 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing/fstest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SourceSuite struct{}
+
+var _ = Suite(&SourceSuite{})
+
+func (s *SourceSuite) TestExtensions(c *C) {
+	fs := fstest.MapFS{
+		"1_initial.psql": {Data: []byte("-- +migrate Up\nCREATE TABLE people (id int);\n")},
+		"2_record.sql":   {Data: []byte("-- +migrate Up\nINSERT INTO people (id) VALUES (1);\n")},
+		"README.md":      {Data: []byte("# Migrations\n")},
+	}
+
+	migrations, err := HttpFileSystemMigrationSource{FileSystem: http.FS(fs)}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 1)
+	c.Assert(migrations[0].Id, Equals, "2_record.sql")
+
+	migrations, err = HttpFileSystemMigrationSource{
+		FileSystem: http.FS(fs),
+		Extensions: []string{".psql"},
+	}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 1)
+	c.Assert(migrations[0].Id, Equals, "1_initial.psql")
+
+	migrations, err = HttpFileSystemMigrationSource{
+		FileSystem: http.FS(fs),
+		Extensions: []string{".sql", ".psql"},
+	}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 2)
+}
+
+func (s *SourceSuite) TestNextId(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "0009_add_people.sql"},
+			{Id: "0001_initial.sql"},
+			{Id: "0010_add_name.sql"},
+		},
+	}
+
+	id, err := NextId(migrations, SequentialIds)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "0011")
+
+	id, err = NextId(&MemoryMigrationSource{}, SequentialIds)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "1")
+
+	id, err = NextId(migrations, TimestampIds)
+	c.Assert(err, IsNil)
+	c.Assert(id, HasLen, len(timestampIdFormat))
+	c.Assert(migrations.Migrations[2].Less(&Migration{Id: id}), Equals, true)
+
+	// Non numeric Ids always sort last.
+	migrations.Migrations = append(migrations.Migrations, &Migration{Id: "seed.sql"})
+	_, err = NextId(migrations, SequentialIds)
+	c.Assert(err, NotNil)
+}
+
+// chanWatcher is a Watcher reporting the changes sent on its channel.
+type chanWatcher struct {
+	dirs    []string
+	changed chan struct{}
+}
+
+func (w *chanWatcher) Add(dir string) error {
+	w.dirs = append(w.dirs, dir)
+	return nil
+}
+
+func (w *chanWatcher) Changed() <-chan struct{} {
+	return w.changed
+}
+
+func (w *chanWatcher) Close() error {
+	close(w.changed)
+	return nil
+}
+
+func (s *SourceSuite) TestWatchMigrationSource(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "1_initial.sql"), []byte("-- +migrate Up\nSELECT 1;\n"), 0o644), IsNil)
+	watcher := &chanWatcher{changed: make(chan struct{})}
+
+	source, err := NewWatchMigrationSource(FileMigrationSource{Dir: dir}, watcher)
+	c.Assert(err, IsNil)
+	defer source.Close()
+	c.Assert(watcher.dirs, DeepEquals, []string{dir})
+	migrations, err := source.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 1)
+
+	c.Assert(os.WriteFile(filepath.Join(dir, "2_people.sql"), []byte("-- +migrate Up\nCREATE TABLE people (id int);\n"), 0o644), IsNil)
+	watcher.changed <- struct{}{}
+	select {
+	case <-source.Available():
+	case <-time.After(5 * time.Second):
+		c.Fatal("new migrations were not signaled")
+	}
+	migrations, err = source.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 2)
+	c.Assert(migrations[1].Id, Equals, "2_people.sql")
+
+	// Unchanged migrations are not signaled. The change is handled once the
+	// next one is received.
+	watcher.changed <- struct{}{}
+	watcher.changed <- struct{}{}
+	select {
+	case <-source.Available():
+		c.Fatal("unchanged migrations were signaled")
+	default:
+	}
+}
+
+func (s *SourceSuite) TestManifestMigrationSource(c *C) {
+	manifest := filepath.Join(c.MkDir(), "migrations.manifest.json")
+	inner := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE INDEX CONCURRENTLY people_idx ON people (id)"}},
+			{Id: "2", Up: []string{"DELETE FROM people"}, Tags: []string{"data"}},
+			{Id: "3", Up: []string{"SELECT 0"}},
+		},
+	}
+	source := ManifestMigrationSource{Source: inner, Path: manifest}
+
+	c.Assert(os.WriteFile(manifest, []byte(`{
+	"1": {"notransaction": true, "timeout": "10m"},
+	"2": {"irreversible": true, "tags": ["cleanup"]}
+}`), 0o644), IsNil)
+	migrations, err := source.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 3)
+	c.Assert(migrations[0].DisableTransactionUp, Equals, true)
+	c.Assert(migrations[0].DisableTransactionDown, Equals, true)
+	c.Assert(migrations[0].Timeout, Equals, 10*time.Minute)
+	c.Assert(migrations[1].Irreversible, Equals, true)
+	c.Assert(migrations[1].Tags, DeepEquals, []string{"data", "cleanup"})
+	c.Assert(migrations[2], Equals, inner.Migrations[2])
+
+	// The migrations of the source are left untouched.
+	c.Assert(inner.Migrations[0].DisableTransactionUp, Equals, false)
+	c.Assert(inner.Migrations[1].Tags, DeepEquals, []string{"data"})
+
+	c.Assert(os.WriteFile(manifest, []byte(`{"4": {"irreversible": true}}`), 0o644), IsNil)
+	_, err = source.FindMigrations()
+	c.Assert(err, ErrorMatches, "migration manifest .* references unknown migration 4")
+
+	c.Assert(os.WriteFile(manifest, []byte(`{"1": {"no_transaction": true}}`), 0o644), IsNil)
+	_, err = source.FindMigrations()
+	c.Assert(err, ErrorMatches, `failed to parse migration manifest .*: json: unknown field "no_transaction"`)
+
+	c.Assert(os.WriteFile(manifest, []byte(`{"1": {"timeout": "soon"}}`), 0o644), IsNil)
+	_, err = source.FindMigrations()
+	c.Assert(err, ErrorMatches, "invalid timeout of migration 1 in manifest .*")
+}
+
+func (s *SourceSuite) TestTemplateFileMigrationSource(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"1_initial.sql": "-- +migrate Up\nCREATE SCHEMA IF NOT EXISTS tenants;\n",
+		"2_tenants.sql.tmpl": `-- +migrate Up
+{{- range .Tenants }}
+CREATE TABLE tenants.{{ . }}_people (id int);
+{{- end }}
+
+-- +migrate Down
+{{- range .Tenants }}
+DROP TABLE tenants.{{ . }}_people;
+{{- end }}
+`,
+		"notes.txt": "not a migration",
+	}
+	for name, content := range files {
+		c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644), IsNil)
+	}
+
+	migrations, err := TemplateFileMigrationSource{
+		Dir:  dir,
+		Data: map[string]any{"Tenants": []string{"acme", "globex"}},
+	}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 2)
+	c.Assert(migrations[0].Id, Equals, "1_initial.sql")
+	c.Assert(migrations[1].Id, Equals, "2_tenants.sql")
+	c.Assert(migrations[1].Up, DeepEquals, []string{
+		"CREATE TABLE tenants.acme_people (id int);\n",
+		"CREATE TABLE tenants.globex_people (id int);\n",
+	})
+	c.Assert(migrations[1].Down, HasLen, 2)
+}
+
+func (s *SourceSuite) TestMultiMigrationFileSource(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"legacy.sql": `-- +migrate-file 1_people
+-- +migrate Up
+CREATE TABLE people (id int);
+-- +migrate Down
+DROP TABLE people;
+
+-- +migrate-file 2_posts
+-- +migrate Up
+CREATE TABLE posts (id int);
+-- +migrate Down
+DROP TABLE posts;
+`,
+		"3_comments.sql": "-- +migrate Up\nCREATE TABLE comments (id int);\n",
+	}
+	for name, content := range files {
+		c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644), IsNil)
+	}
+
+	migrations, err := MultiMigrationFileSource{Dir: dir}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 3)
+	c.Assert(migrations[0].Id, Equals, "1_people")
+	c.Assert(migrations[0].Up, DeepEquals, []string{"CREATE TABLE people (id int);\n"})
+	c.Assert(migrations[1].Id, Equals, "2_posts")
+	c.Assert(migrations[1].Down, DeepEquals, []string{"DROP TABLE posts;\n"})
+	c.Assert(migrations[2].Id, Equals, "3_comments.sql")
+
+	// Ids must be unique across files.
+	c.Assert(os.WriteFile(filepath.Join(dir, "more.sql"), []byte("-- +migrate-file 2_posts\n-- +migrate Up\nSELECT 1;\n"), 0o644), IsNil)
+	_, err = MultiMigrationFileSource{Dir: dir}.FindMigrations()
+	c.Assert(err, ErrorMatches, "Migration 2_posts is declared in both .*")
+}
+
+func (s *SourceSuite) TestStreamThreshold(c *C) {
+	dir := c.MkDir()
+	files := map[string]string{
+		"1_initial.sql": "-- +migrate Up\nCREATE TABLE people (id int);\n",
+		"2_seed.sql":    "-- +migrate Up\nINSERT INTO people VALUES (1);\nINSERT INTO people VALUES (2);\n\n-- +migrate Down\nDELETE FROM people;\n",
+	}
+	for name, content := range files {
+		c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644), IsNil)
+	}
+
+	loaded, err := FileMigrationSource{Dir: dir}.FindMigrations()
+	c.Assert(err, IsNil)
+	streamed, err := FileMigrationSource{Dir: dir, StreamThreshold: 50}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(streamed, HasLen, 2)
+
+	// Only the large file is streamed, and keeps its checksum.
+	c.Assert(streamed[0].Up, DeepEquals, loaded[0].Up)
+	c.Assert(streamed[1].Up, HasLen, 0)
+	c.Assert(streamed[1].Checksum(), Equals, loaded[1].Checksum())
+	c.Assert(streamed[1].statementCount(Up), Equals, 2)
+	c.Assert(streamed[1].statementCount(Down), Equals, 1)
+
+	var queries []string
+	err = newPlannedMigration(streamed[1], Up).eachQuery(func(i int, query string) error {
+		c.Assert(i, Equals, len(queries))
+		queries = append(queries, query)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(queries, DeepEquals, loaded[1].Up)
+
+	_, err = Squash(&MemoryMigrationSource{Migrations: streamed}, "1_initial.sql", "2_seed.sql")
+	c.Assert(err, FitsTypeOf, &PlanError{})
+}
+
+func (s *SourceSuite) TestStreamedChecks(c *C) {
+	dir := c.MkDir()
+	content := "-- +migrate Up\nCREATE TABLE people (id int);\nCOMMIT;\n\n-- +migrate Down\n  \n"
+	c.Assert(os.WriteFile(filepath.Join(dir, "1_commit.sql"), []byte(content), 0o644), IsNil)
+	streamed, err := FileMigrationSource{Dir: dir, StreamThreshold: 1}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(streamed, HasLen, 1)
+	c.Assert(streamed[0].stream, NotNil)
+
+	// Streamed statements are checked like loaded ones.
+	errs := MigrationSet{RequireDown: true}.checkMigrations(streamed)
+	c.Assert(errs, HasLen, 2)
+	c.Assert(errs[0], ErrorMatches, `.*statement "COMMIT;" controls the transaction.*`)
+	c.Assert(errs[1], ErrorMatches, ".*migration has no Down statements")
+	c.Assert(streamed[0].hasStatements(Up), Equals, true)
+	c.Assert(streamed[0].hasStatements(Down), Equals, false)
+}
+
+func (s *SourceSuite) TestIdPattern(c *C) {
+	fs := fstest.MapFS{
+		"V2024.01.10__add_name.sql":   {Data: []byte("-- +migrate Up\nALTER TABLE people ADD COLUMN name text;\n")},
+		"V2024.01.02__add_people.sql": {Data: []byte("-- +migrate Up\nCREATE TABLE people (id int);\n")},
+	}
+	source := HttpFileSystemMigrationSource{FileSystem: http.FS(fs)}
+
+	ms := MigrationSet{IdPattern: regexp.MustCompile(`^V([\d.]+)__`)}
+	migrations, err := ms.findMigrations(source)
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 2)
+	c.Assert(migrations[0].Id, Equals, "2024.01.02")
+	c.Assert(migrations[1].Id, Equals, "2024.01.10")
+
+	// Without a pattern the whole filename is the Id.
+	migrations, err = MigrationSet{}.findMigrations(source)
+	c.Assert(err, IsNil)
+	c.Assert(migrations[0].Id, Equals, "V2024.01.02__add_people.sql")
+
+	// Ids derived from the names also sort the next one.
+	id, err := ms.NextId(source, SequentialIds)
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "2025")
+	c.Assert(ms.ValidateSource(source), IsNil)
+
+	fs["add_email.sql"] = &fstest.MapFile{Data: []byte("-- +migrate Up\nALTER TABLE people ADD COLUMN email text;\n")}
+	_, err = ms.findMigrations(source)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	_, err = ms.NextId(source, SequentialIds)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+
+	// Validation reports every name not matching.
+	fs["V2024.01.10__add_email.sql"] = &fstest.MapFile{Data: []byte("-- +migrate Up\nALTER TABLE people ADD COLUMN email text;\n")}
+	err = ms.ValidateSource(source)
+	c.Assert(err, ErrorMatches, `.*V2024.01.10__add_name.sql: migration Id 2024.01.10 is also used by V2024.01.10__add_email.sql\n.*add_email.sql: migration name does not match .*`)
+}
+
+// mapTree is a TreeReader over file contents keyed by path.
+type mapTree map[string]string
+
+func (t mapTree) ReadFile(name string) ([]byte, error) {
+	content, ok := t[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(content), nil
+}
+
+func (t mapTree) ReadDir(dir string) ([]string, error) {
+	var names []string
+	for name := range t {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	return names, nil
+}
+
+func (s *SourceSuite) TestTreeMigrationSource(c *C) {
+	tree := mapTree{
+		"db/migrations/2_record.sql":  "-- +migrate Up\nINSERT INTO people (id) VALUES (1);\n",
+		"db/migrations/1_initial.sql": "-- +migrate Up\nCREATE TABLE people (id int);\n\n-- +migrate Down\nDROP TABLE people;\n",
+		"db/migrations/README.md":     "# Migrations\n",
+		"db/seeds.sql":                "-- +migrate Up\nSELECT 1;\n",
+	}
+
+	migrations, err := TreeMigrationSource{Tree: tree, Dir: "db/migrations"}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 2)
+	c.Assert(migrations[0].Id, Equals, "1_initial.sql")
+	c.Assert(migrations[0].Up, HasLen, 1)
+	c.Assert(migrations[0].Down, HasLen, 1)
+	c.Assert(migrations[1].Id, Equals, "2_record.sql")
+}
+
+func (s *SourceSuite) TestDuplicatePrefixPolicy(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "0004_people.sql"},
+			{Id: "0005_b.sql"},
+			{Id: "0005_a.sql"},
+		},
+	}
+
+	found, err := MigrationSet{}.findMigrations(migrations)
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 3)
+
+	_, err = MigrationSet{DuplicatePrefixPolicy: ErrorDuplicatePrefix}.findMigrations(migrations)
+	c.Assert(err, ErrorMatches, ".*0005_b.sql.*0005_a.sql")
+
+	_, err = MigrationSet{DuplicatePrefixPolicy: ErrorDuplicatePrefix}.findMigrations(&MemoryMigrationSource{Migrations: migrations.Migrations[:2]})
+	c.Assert(err, IsNil)
+}
+
+// recordingLogger keeps the messages logged through it.
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...any) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (s *SourceSuite) TestParseMigrationFile(c *C) {
+	path := filepath.Join(c.MkDir(), "1_people.sql")
+	c.Assert(os.WriteFile(path, []byte(`-- +migrate Up notransaction
+CREATE INDEX CONCURRENTLY people_id_idx ON people (id);
+
+-- +migrate Down
+-- +migrate irreversible
+`), 0o644), IsNil)
+
+	migration, err := ParseMigrationFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(migration.Id, Equals, "1_people.sql")
+	c.Assert(migration.Up, HasLen, 1)
+	c.Assert(migration.Down, HasLen, 0)
+	c.Assert(migration.DisableTransactionUp, Equals, true)
+	c.Assert(migration.Irreversible, Equals, true)
+
+	_, err = ParseMigrationFile(filepath.Join(filepath.Dir(path), "2_missing.sql"))
+	c.Assert(err, ErrorMatches, "Error while opening .*2_missing.sql: .*")
+}
+
+func (s *SourceSuite) TestRequireMigrations(c *C) {
+	ctx := context.Background()
+	empty := &MemoryMigrationSource{}
+
+	// Empty sources look like an up to date database, with a warning.
+	logger := &recordingLogger{}
+	db := &fakeQueryer{rows: [][]any{{false}, {true}}, queryErr: errors.New("connection lost")}
+	_, err := MigrationSet{Logger: logger}.PlanMigration(ctx, db, empty, Up, 0)
+	c.Assert(err, ErrorMatches, ".*connection lost")
+	c.Assert(logger.messages, DeepEquals, []string{"warning: migration source has no migrations"})
+	c.Assert(ValidateSource(empty), IsNil)
+
+	ms := MigrationSet{RequireMigrations: true}
+	_, err = ms.PlanMigration(ctx, &fakeQueryer{rows: [][]any{{false}, {true}}}, empty, Up, 0)
+	c.Assert(err, Equals, ErrEmptySource)
+	c.Assert(errors.Is(ms.ValidateSource(empty), ErrEmptySource), Equals, true)
+	c.Assert(ms.ValidateSource(&MemoryMigrationSource{Migrations: testMigrations}), IsNil)
+}
+
+func (s *SourceSuite) TestNoTransactionStatements(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE INDEX CONCURRENTLY people_id_idx ON people (id)"}, DisableTransactionUp: true},
+			{Id: "2", Up: []string{"CREATE INDEX CONCURRENTLY a ON people (id)", "CREATE INDEX CONCURRENTLY b ON people (id)"}, DisableTransactionUp: true},
+			{Id: "3", Up: []string{"SELECT 1", "SELECT 2"}},
+		},
+	}
+
+	logger := &recordingLogger{}
+	found, err := MigrationSet{Logger: logger}.findMigrations(migrations)
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 3)
+	c.Assert(logger.messages, HasLen, 1)
+	c.Assert(logger.messages[0], Matches, ".*migration 2 .*")
+
+	_, err = MigrationSet{StrictNoTransaction: true}.findMigrations(migrations)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "2")
+}
+
+func (s *SourceSuite) TestTransactionControlStatements(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int);", "CREATE FUNCTION f() RETURNS void AS $$\nBEGIN\nEND;\n$$ LANGUAGE plpgsql;"}},
+			{Id: "2", Up: []string{"SAVEPOINT a;", "ROLLBACK TO SAVEPOINT a;", "DO $$ BEGIN END $$;"}},
+			{Id: "3", Up: []string{"BEGIN;", "DROP TABLE people;"}, DisableTransactionUp: true},
+		},
+	}
+	found, err := MigrationSet{}.findMigrations(migrations)
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 3)
+
+	migrations.Migrations = append(migrations.Migrations, &Migration{
+		Id:   "4",
+		Up:   []string{"UPDATE people SET id = id + 1;", "-- done\ncommit;"},
+		Down: []string{"SELECT 0;"},
+	})
+	_, err = MigrationSet{}.findMigrations(migrations)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "4")
+	c.Assert(err, ErrorMatches, `.*statement ".*commit;" controls the transaction .*`)
+}
+
+func (s *SourceSuite) TestMaxStatementsPerMigration(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 1", "SELECT 2"}, Down: []string{"SELECT 1"}},
+			{Id: "2", Up: []string{"SELECT 1"}, Down: []string{"SELECT 1", "SELECT 2", "SELECT 3"}},
+		},
+	}
+
+	found, err := MigrationSet{}.findMigrations(migrations)
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 2)
+
+	_, err = MigrationSet{MaxStatementsPerMigration: 2}.findMigrations(migrations)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "2")
+
+	_, err = MigrationSet{MaxStatementsPerMigration: 1}.findMigrations(migrations)
+	c.Assert(err, FitsTypeOf, &PlanError{})
+	c.Assert(err.(*PlanError).Migration.Id, Equals, "1")
+}
+
+func (s *SourceSuite) TestFilterMigrationSource(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "20230101000000_initial.sql"},
+			{Id: "20240101000000_people.sql"},
+			{Id: "20240201000000_pets.sql"},
+		},
+	}
+
+	filtered := FilterMigrationSource(migrations, func(m *Migration) bool {
+		return m.Id >= "2024"
+	})
+	found, err := filtered.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 2)
+	c.Assert(found[0].Id, Equals, "20240101000000_people.sql")
+	c.Assert(found[1].Id, Equals, "20240201000000_pets.sql")
+}
+
+func (s *SourceSuite) TestCombinedMigrationSource(c *C) {
+	production := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1_initial.sql", Up: []string{"CREATE TABLE people (id int)"}},
+			{Id: "2_record.sql", Up: []string{"INSERT INTO people (id) VALUES (1)"}},
+		},
+	}
+	overrides := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "2_record.sql", Up: []string{"SELECT 1"}},
+			{Id: "3_fixture.sql", Up: []string{"INSERT INTO people (id) VALUES (2)"}},
+		},
+	}
+
+	combined := CombineMigrationSources(production, overrides)
+	found, err := combined.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 3)
+	c.Assert(found[0].Id, Equals, "1_initial.sql")
+	c.Assert(found[1].Id, Equals, "2_record.sql")
+	c.Assert(found[1].Up, DeepEquals, []string{"SELECT 1"})
+	c.Assert(found[2].Id, Equals, "3_fixture.sql")
+
+	combined.RejectDuplicates = true
+	_, err = combined.FindMigrations()
+	c.Assert(err, ErrorMatches, "migration 2_record.sql is provided by several sources")
+}
+
+func (s *SourceSuite) TestGlobMigrationSource(c *C) {
+	fsys := fstest.MapFS{
+		"db/core/V1__people.sql":      {Data: []byte("-- +migrate Up\nCREATE TABLE people (id int);\n")},
+		"db/core/nested/V3__pets.sql": {Data: []byte("-- +migrate Up\nCREATE TABLE pets (id int);\n")},
+		"db/billing/V2__invoices.sql": {Data: []byte("-- +migrate Up\nCREATE TABLE invoices (id int);\n")},
+		"db/billing/README.md":        {Data: []byte("not a migration")},
+	}
+
+	migrations, err := GlobMigrationSource{FileSystem: fsys, Pattern: "db/*/V*.sql"}.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 2)
+	c.Assert(migrations[0].Id, Equals, "V1__people.sql")
+	c.Assert(migrations[1].Id, Equals, "V2__invoices.sql")
+
+	// A matcher can select files at any depth.
+	recursive := GlobMigrationSource{
+		FileSystem: fsys,
+		Match: func(name string) (bool, error) {
+			return strings.HasPrefix(name, "db/") && path.Ext(name) == ".sql", nil
+		},
+	}
+	migrations, err = recursive.FindMigrations()
+	c.Assert(err, IsNil)
+	c.Assert(migrations, HasLen, 3)
+	c.Assert(migrations[2].Id, Equals, "V3__pets.sql")
+
+	fsys["db/billing/V1__people.sql"] = &fstest.MapFile{Data: []byte("-- +migrate Up\nSELECT 1;\n")}
+	_, err = recursive.FindMigrations()
+	c.Assert(err, ErrorMatches, "migration V1__people.sql is both in .* and .*")
+}
+
+func (s *SourceSuite) TestSquash(c *C) {
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"CREATE TABLE people (id int)"}, Down: []string{"DROP TABLE people"}},
+			{Id: "2", Up: []string{"ALTER TABLE people ADD name text"}, Down: []string{"ALTER TABLE people DROP name"}, Requires: []Requirement{{Kind: RequirementVersion, Value: "12"}}},
+			{Id: "3", Up: []string{"CREATE TABLE pets (id int)", "CREATE INDEX ON pets (id)"}, Down: []string{"DROP TABLE pets"}, Requires: []Requirement{{Kind: RequirementVersion, Value: "12"}}},
+			{Id: "4", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+		},
+	}
+
+	squashed, err := Squash(migrations, "1", "3")
+	c.Assert(err, IsNil)
+	c.Assert(squashed.Id, Equals, "3_squashed")
+	c.Assert(squashed.Replaces, DeepEquals, []string{"1", "2", "3"})
+	c.Assert(squashed.Up, DeepEquals, []string{
+		"CREATE TABLE people (id int)",
+		"ALTER TABLE people ADD name text",
+		"CREATE TABLE pets (id int)",
+		"CREATE INDEX ON pets (id)",
+	})
+	c.Assert(squashed.Down, DeepEquals, []string{
+		"DROP TABLE pets",
+		"ALTER TABLE people DROP name",
+		"DROP TABLE people",
+	})
+	c.Assert(squashed.Requires, DeepEquals, []Requirement{{Kind: RequirementVersion, Value: "12"}})
+	c.Assert(squashed.Less(migrations.Migrations[3]), Equals, true)
+
+	// The bookkeeping of new databases is pluggable.
+	var replaced []string
+	ms := MigrationSet{
+		SquashRecords: func(migrations []*Migration) (up, down []string) {
+			for _, migration := range migrations {
+				replaced = append(replaced, migration.Id)
+			}
+			return []string{"SELECT 1"}, []string{"SELECT 2"}
+		},
+	}
+	squashed, err = ms.Squash(migrations, "2", "4")
+	c.Assert(err, IsNil)
+	c.Assert(squashed.Id, Equals, "4_squashed")
+	c.Assert(replaced, DeepEquals, []string{"2", "3", "4"})
+	c.Assert(squashed.Up, HasLen, 5)
+	c.Assert(squashed.Up[4], Equals, "SELECT 1")
+	c.Assert(squashed.Down, DeepEquals, []string{"SELECT 0", "DROP TABLE pets", "ALTER TABLE people DROP name", "SELECT 2"})
+
+	_, err = Squash(migrations, "1", "5")
+	c.Assert(err, FitsTypeOf, &PlanError{})
+
+	migrations.Migrations[1].DisableTransactionUp = true
+	_, err = Squash(migrations, "1", "3")
+	c.Assert(err, FitsTypeOf, &PlanError{})
+}
+
+func (s *SourceSuite) TestSourceDiff(c *C) {
+	main := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1_initial.sql", Up: []string{"CREATE TABLE people (id int);"}},
+			{Id: "2_record.sql", Up: []string{"INSERT INTO people (id) VALUES (1);"}},
+			{Id: "3_posts.sql", Up: []string{"CREATE TABLE posts (id int);"}},
+		},
+	}
+	branch := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1_initial.sql", Up: []string{"CREATE TABLE people (id int);"}},
+			{Id: "3_posts.sql", Up: []string{"CREATE TABLE posts (id bigint);"}},
+			{Id: "4_comments.sql", Up: []string{"CREATE TABLE comments (id int);"}},
+			{Id: "5_likes.sql", Up: []string{"CREATE TABLE likes (id int);"}},
+		},
+	}
+
+	added, removed, modified, err := SourceDiff(main, branch)
+	c.Assert(err, IsNil)
+	c.Assert(added, DeepEquals, []string{"4_comments.sql", "5_likes.sql"})
+	c.Assert(removed, DeepEquals, []string{"2_record.sql"})
+	c.Assert(modified, DeepEquals, []string{"3_posts.sql"})
+
+	added, removed, modified, err = SourceDiff(main, main)
+	c.Assert(err, IsNil)
+	c.Assert(added, HasLen, 0)
+	c.Assert(removed, HasLen, 0)
+	c.Assert(modified, HasLen, 0)
+}
+
+func (s *SourceSuite) TestValidateSource(c *C) {
+	fsys := fstest.MapFS{
+		"1_people.sql":    {Data: []byte("-- +migrate Up\nCREATE TABLE people (id int);\n")},
+		"2_pets.sql":      {Data: []byte("-- +migrate Up\nCREATE TABLE pets (id int)\n")},
+		"3_function.sql":  {Data: []byte("-- +migrate Up\n-- +migrate StatementBegin\nCREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;\n")},
+		"4_no_annotation": {Data: []byte("not a migration")},
+	}
+
+	err := ValidateSource(HttpFileSystemMigrationSource{FileSystem: http.FS(fsys)})
+	c.Assert(err, NotNil)
+	c.Assert(err, ErrorMatches, `(?s)Error while parsing 2_pets.sql: .*semicolon.*\nError while parsing 3_function.sql: .*StatementEnd.*`)
+
+	delete(fsys, "2_pets.sql")
+	delete(fsys, "3_function.sql")
+	err = ValidateSource(HttpFileSystemMigrationSource{FileSystem: http.FS(fsys)})
+	c.Assert(err, IsNil)
+
+	// Structural problems are all reported too.
+	migrations := &MemoryMigrationSource{
+		Migrations: []*Migration{
+			{Id: "1", Up: []string{"SELECT 0"}},
+			{Id: "1", Up: []string{"SELECT 0"}, Down: []string{"SELECT 0"}},
+			{Id: "2", Up: []string{"SELECT 0"}},
+		},
+	}
+	err = MigrationSet{RequireDown: true}.ValidateSource(migrations)
+	c.Assert(err, NotNil)
+	lines := strings.Split(err.Error(), "\n")
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0], Matches, ".* 1: migration Id is not unique")
+	c.Assert(lines[1], Matches, ".* 1: migration has no Down statements")
+	c.Assert(lines[2], Matches, ".* 2: migration has no Down statements")
+}
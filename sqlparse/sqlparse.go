@@ -13,6 +13,10 @@ import (
 const (
 	sqlCmdPrefix        = "-- +migrate "
 	optionNoTransaction = "notransaction"
+	byteOrderMark       = "\uFEFF"
+	cmdIrreversible     = "irreversible"
+	cmdContinueOnError  = "continueOnError"
+	fileHeaderPrefix    = "-- +migrate-file"
 )
 
 type ParsedMigration struct {
@@ -21,6 +25,91 @@ type ParsedMigration struct {
 
 	DisableTransactionUp   bool
 	DisableTransactionDown bool
+
+	Requirements []Requirement
+
+	ParallelGroup string
+
+	Irreversible bool
+
+	// ContinueOnError is set by a '-- +migrate continueOnError' annotation.
+	ContinueOnError bool
+
+	// Replaces lists the Ids declared with '-- +migrate replaces <id>...'
+	// annotations.
+	Replaces []string
+}
+
+// Requirement is a precondition declared with a '-- +migrate requires <kind> <value>'
+// annotation, for example '-- +migrate requires extension pg_trgm'.
+type Requirement struct {
+	Kind  string
+	Value string
+}
+
+// MigrationSection is one of the migrations declared in a single file, see
+// SplitMigrationFile.
+type MigrationSection struct {
+	Id   string
+	Body string
+}
+
+// SplitMigrationFile splits a file declaring several migrations, each starting
+// with a '-- +migrate-file <id>' header followed by its Up and Down sections,
+// into one section per migration. The bodies are left to ParseMigration. Files
+// without any header return no section.
+func SplitMigrationFile(r io.Reader) ([]MigrationSection, error) {
+	var sections []MigrationSection
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	firstLine := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if firstLine {
+			line = strings.TrimPrefix(line, byteOrderMark)
+			firstLine = false
+		}
+
+		if line == fileHeaderPrefix || strings.HasPrefix(line, fileHeaderPrefix+" ") {
+			fields := strings.Fields(line[len(fileHeaderPrefix):])
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("ERROR: '-- +migrate-file' expects a migration id, got %q", strings.Join(fields, " "))
+			}
+			if len(sections) > 0 {
+				sections[len(sections)-1].Body = buf.String()
+			} else if hasStatements(buf.String()) {
+				return nil, errors.New("ERROR: saw statements or annotations before the first '-- +migrate-file' header")
+			}
+			buf.Reset()
+			sections = append(sections, MigrationSection{Id: fields[0]})
+			continue
+		}
+
+		if _, err := buf.WriteString(line + "\n"); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(sections) > 0 {
+		sections[len(sections)-1].Body = buf.String()
+	}
+	return sections, nil
+}
+
+// Reports whether the text has anything but blank lines and plain comments.
+func hasStatements(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && (!strings.HasPrefix(line, "--") || strings.HasPrefix(line, "-- +")) {
+			return true
+		}
+	}
+	return false
 }
 
 var (
@@ -120,6 +209,35 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 		return nil, err
 	}
 
+	err = parse(r, p, func(up bool, statement string) error {
+		if up {
+			p.UpStatements = append(p.UpStatements, statement)
+		} else {
+			p.DownStatements = append(p.DownStatements, statement)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ParseMigrationStream parses the migration like ParseMigration, but calls fn
+// with each statement as soon as it is read instead of collecting them, so
+// that large migrations are never held in memory. The statements of the
+// returned migration are left empty. Errors returned by fn stop the parsing.
+func ParseMigrationStream(r io.Reader, fn func(up bool, statement string) error) (*ParsedMigration, error) {
+	p := &ParsedMigration{}
+	if err := parse(r, p, fn); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Parses the migration into p, emitting its statements.
+func parse(r io.Reader, p *ParsedMigration, emit func(up bool, statement string) error) error {
+	downStatements := 0
 	var buf bytes.Buffer
 	scanner := bufio.NewScanner(r)
 	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
@@ -128,8 +246,14 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 	ignoreSemicolons := false
 	currentDirection := directionNone
 
+	firstLine := true
 	for scanner.Scan() {
 		line := scanner.Text()
+		// strip the UTF-8 byte order mark some editors start files with
+		if firstLine {
+			line = strings.TrimPrefix(line, byteOrderMark)
+			firstLine = false
+		}
 		// ignore comment except beginning with '-- +'
 		if strings.HasPrefix(line, "-- ") && !strings.HasPrefix(line, "-- +") {
 			continue
@@ -139,13 +263,13 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 		if strings.HasPrefix(line, sqlCmdPrefix) {
 			cmd, err := parseCommand(line)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			switch cmd.Command {
 			case "Up":
 				if len(strings.TrimSpace(buf.String())) > 0 {
-					return nil, errNoTerminator()
+					return errNoTerminator()
 				}
 				currentDirection = directionUp
 				if cmd.HasOption(optionNoTransaction) {
@@ -155,7 +279,7 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 
 			case "Down":
 				if len(strings.TrimSpace(buf.String())) > 0 {
-					return nil, errNoTerminator()
+					return errNoTerminator()
 				}
 				currentDirection = directionDown
 				if cmd.HasOption(optionNoTransaction) {
@@ -163,6 +287,38 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 				}
 				break
 
+			case "requires":
+				if len(cmd.Options) != 2 {
+					return fmt.Errorf("ERROR: '-- +migrate requires' expects a kind and a value, got %q", strings.Join(cmd.Options, " "))
+				}
+				p.Requirements = append(p.Requirements, Requirement{Kind: cmd.Options[0], Value: cmd.Options[1]})
+				break
+
+			case "replaces":
+				if len(cmd.Options) == 0 {
+					return errors.New("ERROR: '-- +migrate replaces' expects the Ids of the replaced migrations")
+				}
+				p.Replaces = append(p.Replaces, cmd.Options...)
+				break
+
+			case "parallel-group":
+				if len(cmd.Options) != 1 {
+					return fmt.Errorf("ERROR: '-- +migrate parallel-group' expects a group name, got %q", strings.Join(cmd.Options, " "))
+				}
+				p.ParallelGroup = cmd.Options[0]
+				break
+
+			case cmdIrreversible:
+				if currentDirection != directionDown {
+					return errors.New("ERROR: '-- +migrate irreversible' must be in the Down section")
+				}
+				p.Irreversible = true
+				break
+
+			case cmdContinueOnError:
+				p.ContinueOnError = true
+				break
+
 			case "StatementBegin":
 				if currentDirection != directionNone {
 					ignoreSemicolons = true
@@ -186,7 +342,7 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 
 		if !isLineSeparator && !strings.HasPrefix(line, "-- +") {
 			if _, err := buf.WriteString(line + "\n"); err != nil {
-				return nil, err
+				return err
 			}
 		}
 
@@ -197,10 +353,15 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 			statementEnded = false
 			switch currentDirection {
 			case directionUp:
-				p.UpStatements = append(p.UpStatements, buf.String())
+				if err := emit(true, buf.String()); err != nil {
+					return err
+				}
 
 			case directionDown:
-				p.DownStatements = append(p.DownStatements, buf.String())
+				downStatements++
+				if err := emit(false, buf.String()); err != nil {
+					return err
+				}
 
 			default:
 				panic("impossible state")
@@ -211,16 +372,16 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// diagnose likely migration script errors
 	if ignoreSemicolons {
-		return nil, errors.New("ERROR: saw '-- +migrate StatementBegin' with no matching '-- +migrate StatementEnd'")
+		return errors.New("ERROR: saw '-- +migrate StatementBegin' with no matching '-- +migrate StatementEnd'")
 	}
 
 	if currentDirection == directionNone {
-		return nil, errors.New(`ERROR: no Up/Down annotations found, so no statements were executed.
+		return errors.New(`ERROR: no Up/Down annotations found, so no statements were executed.
 			See https://github.com/heroiclabs/sql-migrate for details.`)
 	}
 
@@ -228,8 +389,16 @@ func ParseMigration(r io.ReadSeeker) (*ParsedMigration, error) {
 	// -- +migrate Down
 	// -- nothing to downgrade!
 	if len(strings.TrimSpace(buf.String())) > 0 && !strings.HasPrefix(buf.String(), "-- +") {
-		return nil, errNoTerminator()
+		return errNoTerminator()
 	}
 
-	return p, nil
+	if p.ContinueOnError && (p.DisableTransactionUp || p.DisableTransactionDown) {
+		return errors.New("ERROR: a continueOnError migration cannot use notransaction")
+	}
+
+	if p.Irreversible && downStatements > 0 {
+		return errors.New("ERROR: an irreversible migration cannot have Down statements")
+	}
+
+	return nil
 }
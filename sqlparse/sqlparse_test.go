@@ -126,6 +126,112 @@ func (s *SqlParseSuite) TestCustomTerminator(c *C) {
 	}
 }
 
+func (s *SqlParseSuite) TestRequirements(c *C) {
+	migration, err := ParseMigration(strings.NewReader(requirestxt))
+	c.Assert(err, IsNil)
+	c.Assert(migration.Requirements, DeepEquals, []Requirement{
+		{Kind: "extension", Value: "pg_trgm"},
+		{Kind: "version", Value: "12"},
+	})
+	c.Assert(migration.UpStatements, HasLen, 1)
+	c.Assert(migration.DownStatements, HasLen, 1)
+
+	_, err = ParseMigration(strings.NewReader("-- +migrate requires extension\n-- +migrate Up\nSELECT 1;\n"))
+	c.Assert(err, NotNil)
+}
+
+func (s *SqlParseSuite) TestReplaces(c *C) {
+	migration, err := ParseMigration(strings.NewReader("-- +migrate replaces 1_people.sql 2_posts.sql\n-- +migrate replaces 3_tags.sql\n-- +migrate Up\nSELECT 1;\n"))
+	c.Assert(err, IsNil)
+	c.Assert(migration.Replaces, DeepEquals, []string{"1_people.sql", "2_posts.sql", "3_tags.sql"})
+
+	_, err = ParseMigration(strings.NewReader("-- +migrate replaces\n-- +migrate Up\nSELECT 1;\n"))
+	c.Assert(err, ErrorMatches, "ERROR: '-- \\+migrate replaces' expects the Ids of the replaced migrations")
+}
+
+func (s *SqlParseSuite) TestParallelGroup(c *C) {
+	migration, err := ParseMigration(strings.NewReader("-- +migrate parallel-group backfill\n-- +migrate Up\nUPDATE people SET name = '';\n"))
+	c.Assert(err, IsNil)
+	c.Assert(migration.ParallelGroup, Equals, "backfill")
+	c.Assert(migration.UpStatements, HasLen, 1)
+
+	_, err = ParseMigration(strings.NewReader("-- +migrate parallel-group\n-- +migrate Up\nSELECT 1;\n"))
+	c.Assert(err, NotNil)
+}
+
+func (s *SqlParseSuite) TestIrreversible(c *C) {
+	migration, err := ParseMigration(strings.NewReader("-- +migrate Up\nDELETE FROM people;\n\n-- +migrate Down\n-- +migrate irreversible\n"))
+	c.Assert(err, IsNil)
+	c.Assert(migration.Irreversible, Equals, true)
+	c.Assert(migration.UpStatements, HasLen, 1)
+	c.Assert(migration.DownStatements, HasLen, 0)
+
+	_, err = ParseMigration(strings.NewReader("-- +migrate irreversible\n-- +migrate Up\nSELECT 1;\n"))
+	c.Assert(err, NotNil)
+
+	_, err = ParseMigration(strings.NewReader("-- +migrate Up\nSELECT 1;\n-- +migrate Down\n-- +migrate irreversible\nSELECT 1;\n"))
+	c.Assert(err, NotNil)
+}
+
+func (s *SqlParseSuite) TestContinueOnError(c *C) {
+	migration, err := ParseMigration(strings.NewReader("-- +migrate continueOnError\n-- +migrate Up\nDROP INDEX a;\nDROP INDEX b;\n"))
+	c.Assert(err, IsNil)
+	c.Assert(migration.ContinueOnError, Equals, true)
+	c.Assert(migration.UpStatements, HasLen, 2)
+
+	_, err = ParseMigration(strings.NewReader("-- +migrate continueOnError\n-- +migrate Up notransaction\nDROP INDEX CONCURRENTLY a;\n"))
+	c.Assert(err, NotNil)
+}
+
+func (s *SqlParseSuite) TestSplitMigrationFile(c *C) {
+	sections, err := SplitMigrationFile(strings.NewReader(multifiletxt))
+	c.Assert(err, IsNil)
+	c.Assert(sections, HasLen, 2)
+	c.Assert(sections[0].Id, Equals, "1_people")
+	c.Assert(sections[1].Id, Equals, "2_posts")
+
+	migration, err := ParseMigration(strings.NewReader(sections[1].Body))
+	c.Assert(err, IsNil)
+	c.Assert(migration.UpStatements, DeepEquals, []string{"CREATE TABLE posts (id int);\n"})
+	c.Assert(migration.DownStatements, HasLen, 1)
+
+	// Files without headers have no section.
+	sections, err = SplitMigrationFile(strings.NewReader(multitxt))
+	c.Assert(err, IsNil)
+	c.Assert(sections, HasLen, 0)
+
+	_, err = SplitMigrationFile(strings.NewReader("-- +migrate Up\nSELECT 1;\n-- +migrate-file 1_people\n"))
+	c.Assert(err, NotNil)
+	_, err = SplitMigrationFile(strings.NewReader("-- +migrate-file\n-- +migrate Up\nSELECT 1;\n"))
+	c.Assert(err, NotNil)
+}
+
+func (s *SqlParseSuite) TestParseMigrationStream(c *C) {
+	var up, down []string
+	migration, err := ParseMigrationStream(strings.NewReader(multitxt), func(isUp bool, statement string) error {
+		if isUp {
+			up = append(up, statement)
+		} else {
+			down = append(down, statement)
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(migration.UpStatements, HasLen, 0)
+
+	parsed, err := ParseMigration(strings.NewReader(multitxt))
+	c.Assert(err, IsNil)
+	c.Assert(up, DeepEquals, parsed.UpStatements)
+	c.Assert(down, DeepEquals, parsed.DownStatements)
+}
+
+func (s *SqlParseSuite) TestByteOrderMark(c *C) {
+	migration, err := ParseMigration(strings.NewReader("\uFEFF-- +migrate Up\nCREATE TABLE people (id int);\n\n-- +migrate Down\nDROP TABLE people;\n"))
+	c.Assert(err, IsNil)
+	c.Assert(migration.UpStatements, DeepEquals, []string{"CREATE TABLE people (id int);\n"})
+	c.Assert(migration.DownStatements, HasLen, 1)
+}
+
 var functxt = `-- +migrate Up
 CREATE TABLE IF NOT EXISTS histories (
   id                BIGSERIAL  PRIMARY KEY,
@@ -364,6 +470,33 @@ DROP TABLE fancier_post
 GO
 `
 
+// test several migrations bundled in a single file
+var multifiletxt = `-- legacy migrations, bundled
+-- +migrate-file 1_people
+-- +migrate Up
+CREATE TABLE people (id int);
+
+-- +migrate Down
+DROP TABLE people;
+
+-- +migrate-file 2_posts
+-- +migrate Up
+CREATE TABLE posts (id int);
+
+-- +migrate Down
+DROP TABLE posts;
+`
+
+// test requirements declared before and within a direction
+var requirestxt = `-- +migrate requires extension pg_trgm
+-- +migrate Up
+-- +migrate requires version 12
+CREATE INDEX people_name_trgm_idx ON people USING gin (name gin_trgm_ops);
+
+-- +migrate Down
+DROP INDEX people_name_trgm_idx;
+`
+
 // test a comment without sql instruction
 var justAComment = []string{
 	`-- +migrate Up
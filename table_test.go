@@ -0,0 +1,306 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	. "gopkg.in/check.v1"
+)
+
+type TableSuite struct{}
+
+var _ = Suite(&TableSuite{})
+
+func (s *TableSuite) TestCreateTableOnce(c *C) {
+	// The table is missing, and still missing once created.
+	db := &fakeQueryer{rows: [][]any{{false}}, queryErr: errors.New("relation does not exist")}
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+
+	ms := MigrationSet{}
+	_, err := ms.Exec(context.Background(), db, migrations, Up)
+	c.Assert(err, ErrorMatches, `failed to verify migration table "migration_info" after creating it: .*relation does not exist`)
+
+	creates := 0
+	for _, sql := range db.execs {
+		if strings.Contains(sql, "CREATE TABLE") {
+			creates++
+		}
+	}
+	c.Assert(creates, Equals, 1)
+}
+
+func (s *TableSuite) TestRecordInsertDecorator(c *C) {
+	ctx := context.Background()
+	ms := MigrationSet{
+		RecordColumns: map[string]string{"tenant_id": "BIGINT NOT NULL", "region": "TEXT"},
+		RecordInsertDecorator: func(m *Migration) map[string]any {
+			return map[string]any{"tenant_id": int64(42), "region": "eu"}
+		},
+	}
+
+	db := &fakeQueryer{rows: [][]any{{false}, {true}}}
+	err := ms.createMigrationTable(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(db.execs, HasLen, 1)
+	c.Assert(strings.Contains(db.execs[0], "run_id      TEXT,\n\t\"region\" TEXT,\n\t\"tenant_id\" BIGINT NOT NULL\n)"), Equals, true)
+
+	// The fake reports no affected row, only the statement matters.
+	_ = ms.insertRecord(ctx, db, &Migration{Id: "1"}, false, 0)
+	c.Assert(db.execs, HasLen, 2)
+	c.Assert(db.execs[1], Equals, `INSERT INTO "migration_info" (id, applied_at, checksum, statements, dirty, "region", "tenant_id") VALUES ($1, now(), $2, $3, $4, $5, $6)`)
+}
+
+func (s *TableSuite) TestIdentifierLength(c *C) {
+	ctx := context.Background()
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+	long := strings.Repeat("migration_info_", 5)
+
+	db := &fakeQueryer{rows: [][]any{{63}}}
+	_, err := MigrationSet{TableName: long}.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, `migration table identifier "migration_info_.*" is 75 bytes long, more than the 63 bytes allowed by the database`)
+	c.Assert(db.execs, HasLen, 0)
+
+	db = &fakeQueryer{rows: [][]any{{63}}}
+	_, err = MigrationSet{SchemaName: long}.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, `migration table identifier .* is 75 bytes long, .*`)
+
+	// Servers built with longer identifiers accept them.
+	db = &fakeQueryer{rows: [][]any{{127}}, queryErr: errors.New("relation does not exist")}
+	_, err = MigrationSet{TableName: long}.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, "failed to look up migration table: .*")
+}
+
+func (s *TableSuite) TestDisableCreateTable(c *C) {
+	ctx := context.Background()
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+	ms := MigrationSet{DisableCreateTable: true}
+
+	db := &fakeQueryer{rows: [][]any{{false}}}
+	_, err := ms.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, `migration records table "migration_info" does not exist and DisableCreateTable is enabled`)
+	_, err = ms.PlanMigration(ctx, &fakeQueryer{rows: [][]any{{false}}}, migrations, Up, 0)
+	c.Assert(err, ErrorMatches, `migration records table .* does not exist .*`)
+
+	// Existing tables are checked, but left as they are.
+	db = &fakeQueryer{rows: [][]any{{true}}, queryErr: errors.New("connection lost")}
+	_, err = ms.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, "failed to look up migration table columns: connection lost")
+	c.Assert(db.execs, HasLen, 0)
+}
+
+func (s *TableSuite) TestMissingColumnsError(c *C) {
+	ms := MigrationSet{}
+	err := ms.missingColumnsError(&pgconn.PgError{Code: undefinedColumnCode, Message: `column "apply_seq" does not exist`})
+	c.Assert(err, ErrorMatches, `migration records table "migration_info" is missing columns of this version, run EnsureTableSchema to add them: .*column "apply_seq" does not exist.*`)
+
+	lost := errors.New("connection lost")
+	c.Assert(ms.missingColumnsError(lost), Equals, lost)
+	c.Assert(ms.missingColumnsError(nil), IsNil)
+}
+
+func (s *TableSuite) TestAppliedAtType(c *C) {
+	ctx := context.Background()
+	ms := MigrationSet{AppliedAtType: Timestamp}
+
+	db := &fakeQueryer{rows: [][]any{{false}, {true}}}
+	err := ms.createMigrationTable(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(db.execs, HasLen, 1)
+	c.Assert(db.execs[0], Matches, `(?s).*applied_at  TIMESTAMP   NOT NULL DEFAULT now\(\),.*reverted_at TIMESTAMP,.*`)
+
+	// Existing tables must match.
+	db = &fakeQueryer{rows: [][]any{{true}, {"timestamp with time zone"}}}
+	err = ms.createMigrationTable(ctx, db)
+	c.Assert(err, ErrorMatches, `applied_at column of migration table "migration_info" is timestamp with time zone, but AppliedAtType is timestamp without time zone`)
+	c.Assert(db.execs, HasLen, 0)
+
+	db = &fakeQueryer{rows: [][]any{{true}, {"timestamp without time zone"}}, queryErr: errors.New("catalog unavailable")}
+	err = ms.createMigrationTable(ctx, db)
+	c.Assert(err, ErrorMatches, "failed to look up migration table columns: catalog unavailable")
+
+	err = MigrationSet{AppliedAtType: "DATE"}.createMigrationTable(ctx, &fakeQueryer{})
+	c.Assert(err, ErrorMatches, `invalid AppliedAtType "DATE"`)
+}
+
+func (s *TableSuite) TestTableCreateOptions(c *C) {
+	ctx := context.Background()
+
+	db := &fakeQueryer{rows: [][]any{{false}, {true}}}
+	err := MigrationSet{TableCreateOptions: "unlogged tablespace fast"}.createMigrationTable(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(db.execs, HasLen, 1)
+	c.Assert(db.execs[0], Matches, `(?s)\s*CREATE UNLOGGED TABLE IF NOT EXISTS "migration_info" \(.*\) TABLESPACE "fast"`)
+
+	db = &fakeQueryer{rows: [][]any{{false}, {true}}}
+	err = MigrationSet{}.createMigrationTable(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(db.execs[0], Matches, `(?s)\s*CREATE TABLE IF NOT EXISTS "migration_info" \(.*\)`)
+
+	db = &fakeQueryer{rows: [][]any{{false}}}
+	err = MigrationSet{TableCreateOptions: "TABLESPACE fast; DROP TABLE people"}.createMigrationTable(ctx, db)
+	c.Assert(err, ErrorMatches, `invalid TableCreateOptions .*: only UNLOGGED and TABLESPACE <name> are supported`)
+	c.Assert(db.execs, HasLen, 0)
+}
+
+func (s *TableSuite) TestAppliedPredicate(c *C) {
+	ctx := context.Background()
+	ms := MigrationSet{AppliedPredicate: "status = 'applied'"}
+	db := &fakeQueryer{queryErr: errors.New("connection lost")}
+
+	_, err := ms.GetMigrationRecords(ctx, db)
+	c.Assert(err, NotNil)
+	_, err = ms.CurrentVersion(ctx, db)
+	c.Assert(err, NotNil)
+	c.Assert(db.queries, HasLen, 2)
+	c.Assert(db.queries[0], Matches, `SELECT .* FROM "migration_info" WHERE reverted_at IS NULL AND \(status = 'applied'\) ORDER BY .*`)
+	c.Assert(db.queries[1], Equals, `SELECT id, dirty FROM "migration_info" WHERE reverted_at IS NULL AND (status = 'applied') ORDER BY apply_seq ASC`)
+
+	db = &fakeQueryer{queryErr: errors.New("connection lost")}
+	MigrationSet{}.CurrentVersion(ctx, db)
+	c.Assert(db.queries, DeepEquals, []string{`SELECT id, dirty FROM "migration_info" WHERE reverted_at IS NULL ORDER BY apply_seq ASC`})
+
+	// Records not satisfying the predicate are replaced, with their
+	// RecordColumns reset.
+	ms.RecordColumns = map[string]string{"status": "TEXT NOT NULL DEFAULT 'applied'"}
+	db = &fakeQueryer{rows: [][]any{{true}, {false}}}
+	err = ms.insertRecord(ctx, db, testMigrations[0], false, 0)
+	c.Assert(err, IsNil)
+	c.Assert(db.execs, HasLen, 0)
+	c.Assert(db.queries[0], Matches, `INSERT INTO "migration_info" .* ON CONFLICT \(id\) DO UPDATE SET apply_seq = DEFAULT, reverted_at = NULL, .*, "status" = DEFAULT WHERE \(status = 'applied'\) IS NOT TRUE RETURNING \(status = 'applied'\) IS TRUE`)
+	err = ms.insertRecord(ctx, db, testMigrations[0], false, 0)
+	c.Assert(err, ErrorMatches, "record of migration 123 doesn't satisfy AppliedPredicate once applied")
+	err = ms.insertRecord(ctx, &fakeQueryer{queryErr: pgx.ErrNoRows}, testMigrations[0], false, 0)
+	c.Assert(err, ErrorMatches, "migration 123 is already recorded")
+}
+
+func (s *TableSuite) TestExpectDatabase(c *C) {
+	ctx := context.Background()
+	migrations := &MemoryMigrationSource{
+		Migrations: testMigrations,
+	}
+	ms := MigrationSet{ExpectDatabase: "production", UseAdvisoryLock: true}
+
+	db := &fakeQueryer{rows: [][]any{{"staging"}}}
+	_, err := ms.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, `connected to database "staging", but ExpectDatabase is "production"`)
+	// Nothing else reached the database, not even the lock.
+	c.Assert(db.queries, HasLen, 1)
+	c.Assert(db.execs, HasLen, 0)
+
+	ms = MigrationSet{ExpectDatabase: "production", ExpectServerVersion: "14"}
+	db = &fakeQueryer{rows: [][]any{{"production"}, {"13.4", 130004}}}
+	_, err = ms.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, "server version 13.4 is older than ExpectServerVersion 14")
+
+	// Minor versions are compared within a major version.
+	ms.ExpectServerVersion = "14.2"
+	db = &fakeQueryer{rows: [][]any{{"production"}, {"14.1", 140001}}}
+	_, err = ms.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, "server version 14.1 is older than ExpectServerVersion 14.2")
+
+	// Matching databases go on with the execution.
+	db = &fakeQueryer{rows: [][]any{{"production"}, {"16.2", 160002}}, queryErr: errors.New("connection lost")}
+	_, err = ms.Exec(ctx, db, migrations, Up)
+	c.Assert(err, ErrorMatches, "failed to look up migration table: connection lost")
+
+	_, err = MigrationSet{ExpectServerVersion: "latest"}.Exec(ctx, &fakeQueryer{}, migrations, Up)
+	c.Assert(err, ErrorMatches, `invalid ExpectServerVersion: could not parse version "latest"`)
+}
+
+func (s *TableSuite) TestParseServerVersion(c *C) {
+	tests := []struct {
+		version string
+		num     int
+	}{
+		{version: "9.6", num: 90600},
+		{version: "9.6.24", num: 90624},
+		{version: "10", num: 100000},
+		{version: "14", num: 140000},
+		{version: "14.2", num: 140002},
+		{version: "16.10", num: 160010},
+	}
+	for _, test := range tests {
+		num, err := parseServerVersion(test.version)
+		c.Assert(err, IsNil, Commentf("version %s", test.version))
+		c.Assert(num, Equals, test.num, Commentf("version %s", test.version))
+	}
+
+	for _, version := range []string{"", "latest", "14.2.1", "9.6.24.1", "14.-1", "14beta1"} {
+		_, err := parseServerVersion(version)
+		c.Assert(err, ErrorMatches, fmt.Sprintf("could not parse version %q", version))
+	}
+}
+
+func (s *TableSuite) TestLockRelease(c *C) {
+	ctx := context.Background()
+
+	db := &fakeQueryer{rows: [][]any{{true}, {true}}}
+	unlock, err := MigrationSet{}.lock(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(unlock(), IsNil)
+	c.Assert(db.queries[1], Equals, "SELECT pg_advisory_unlock($1)")
+
+	db = &fakeQueryer{rows: [][]any{{true}, {false}}}
+	unlock, err = MigrationSet{}.lock(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(unlock(), ErrorMatches, "failed to release migration lock .*: it is not held by the connection")
+
+	db = &fakeQueryer{rows: [][]any{{true}}, queryErr: errors.New("connection lost")}
+	unlock, err = MigrationSet{}.lock(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(unlock(), ErrorMatches, "failed to release migration lock: connection lost")
+
+	// Pools could release the lock on another connection.
+	_, err = MigrationSet{}.lock(ctx, &testConnPool{})
+	c.Assert(err, ErrorMatches, "migration lock must be taken on a dedicated connection, not a pool")
+
+	// Failures to release the lock fail the execution.
+	db = &fakeQueryer{rows: [][]any{{true}, {true}}, queryErr: errors.New("connection lost")}
+	_, err = MigrationSet{UseAdvisoryLock: true, DisableCreateTable: true}.Exec(ctx, db, &MemoryMigrationSource{}, Up)
+	c.Assert(err, ErrorMatches, "(?s).*connection lost\nfailed to release migration lock: connection lost")
+}
+
+func (s *TableSuite) TestAsConnPool(c *C) {
+	pool, ok := asConnPool(&pgxpool.Pool{})
+	c.Assert(ok, Equals, true)
+	c.Assert(pool, FitsTypeOf, pgxConnPool{})
+
+	pool, ok = asConnPool(&testConnPool{})
+	c.Assert(ok, Equals, true)
+	c.Assert(pool, FitsTypeOf, &testConnPool{})
+
+	_, ok = asConnPool(&fakeQueryer{})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TableSuite) TestTableExistsSQL(c *C) {
+	ctx := context.Background()
+	ms := MigrationSet{
+		SchemaName: "app",
+		Dialect:    Dialect{TableExistsSQL: "SELECT count(*) > 0 FROM information_schema.tables WHERE table_schema = $1 AND table_name = $2"},
+	}
+
+	db := &fakeQueryer{rows: [][]any{{false}, {true}}}
+	err := ms.createMigrationTable(ctx, db)
+	c.Assert(err, IsNil)
+	c.Assert(db.queries, DeepEquals, []string{ms.Dialect.TableExistsSQL, ms.Dialect.TableExistsSQL})
+	c.Assert(db.execs, HasLen, 1)
+	c.Assert(strings.Contains(db.execs[0], `CREATE TABLE IF NOT EXISTS "app"."migration_info"`), Equals, true)
+
+	// Existing tables are upgraded instead.
+	db = &fakeQueryer{rows: [][]any{{true}}, queryErr: errors.New("catalog unavailable")}
+	err = ms.createMigrationTable(ctx, db)
+	c.Assert(err, ErrorMatches, "failed to look up migration table columns: catalog unavailable")
+	c.Assert(db.execs, HasLen, 0)
+}